@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"localserver/server"
 )
 
 func main() {
-	server.CreateServer()
-}
+	addr := flag.String("addr", "", "listen address, overrides LISTEN_ADDR (default :9000)")
+	flag.Parse()
 
+	server.CreateServer(*addr)
+}
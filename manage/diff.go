@@ -0,0 +1,89 @@
+package manage
+
+import "regexp"
+
+// DiffOp is one run of a word-level diff between the original text and the
+// corrected one. Op is "equal", "delete" or "insert".
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Above this many LCS cells the changed region is reported as a whole
+// delete+insert instead of being diffed word by word.
+const maxDiffCells = 4_000_000
+
+var diffTokens = regexp.MustCompile(`\s+|\S+`)
+
+// diffWords returns the word-level edits that turn original into corrected.
+// Whitespace runs are tokens too, so joining every equal+insert text yields
+// corrected exactly.
+func diffWords(original, corrected string) []DiffOp {
+	a := diffTokens.FindAllString(original, -1)
+	b := diffTokens.FindAllString(corrected, -1)
+
+	// Corrections are usually local; trimming the shared ends keeps the table small.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []DiffOp
+	add := func(op string, tokens ...string) {
+		for _, tok := range tokens {
+			if n := len(ops); n > 0 && ops[n-1].Op == op {
+				ops[n-1].Text += tok
+			} else {
+				ops = append(ops, DiffOp{Op: op, Text: tok})
+			}
+		}
+	}
+
+	add("equal", a[:prefix]...)
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		add("delete", midA...)
+		add("insert", midB...)
+	} else {
+		// lcs[i][j] is the LCS length of midA[i:] and midB[j:].
+		lcs := make([][]int, len(midA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(midB)+1)
+		}
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(midA) && j < len(midB) {
+			switch {
+			case midA[i] == midB[j]:
+				add("equal", midA[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				add("delete", midA[i])
+				i++
+			default:
+				add("insert", midB[j])
+				j++
+			}
+		}
+		add("delete", midA[i:]...)
+		add("insert", midB[j:]...)
+	}
+
+	add("equal", a[len(a)-suffix:]...)
+	return ops
+}
@@ -0,0 +1,67 @@
+package manage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		name      string
+		original  string
+		corrected string
+		want      []DiffOp
+	}{
+		{
+			name:      "word replacements",
+			original:  "I has a apple",
+			corrected: "I have an apple",
+			want: []DiffOp{
+				{Op: "equal", Text: "I "},
+				{Op: "delete", Text: "has"},
+				{Op: "insert", Text: "have"},
+				{Op: "equal", Text: " "},
+				{Op: "delete", Text: "a"},
+				{Op: "insert", Text: "an"},
+				{Op: "equal", Text: " apple"},
+			},
+		},
+		{
+			name:      "insertion",
+			original:  "see you tomorrow",
+			corrected: "see you all tomorrow",
+			want: []DiffOp{
+				{Op: "equal", Text: "see you "},
+				{Op: "insert", Text: "all "},
+				{Op: "equal", Text: "tomorrow"},
+			},
+		},
+		{
+			name:      "unchanged",
+			original:  "All good.",
+			corrected: "All good.",
+			want:      []DiffOp{{Op: "equal", Text: "All good."}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffWords(tt.original, tt.corrected)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diffWords() = %+v, want %+v", got, tt.want)
+			}
+
+			// Equal and insert runs must rebuild the corrected text.
+			var rebuilt strings.Builder
+			for _, op := range got {
+				if op.Op != "delete" {
+					rebuilt.WriteString(op.Text)
+				}
+			}
+			if rebuilt.String() != tt.corrected {
+				t.Errorf("rebuilt = %q, want %q", rebuilt.String(), tt.corrected)
+			}
+		})
+	}
+}
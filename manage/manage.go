@@ -1,6 +1,7 @@
 package manage
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -15,7 +18,15 @@ import (
 )
 
 type Config struct {
-	OpenAIKey string `envconfig:"OPENAI_API_KEY" required:"true"`
+	// Optional so that binaries importing this package, like the server's
+	// test binaries, start without it; /grammar returns 503 instead.
+	OpenAIKey string `envconfig:"OPENAI_API_KEY"`
+	// Models a grammar request may pick; neospeller's default is used otherwise.
+	GrammarModels []string `envconfig:"GRAMMAR_MODELS" default:"gpt-4o-mini,gpt-4.1-mini,gpt-4.1-nano"`
+	// Largest request body accepted for review, to bound OpenAI cost and memory.
+	GrammarMaxBytes int64 `envconfig:"GRAMMAR_MAX_BYTES" default:"51200"`
+	// Path of the neospeller binary; empty means ~/.local/bin/neospeller.
+	NeospellerPath string `envconfig:"NEOSPELLER_PATH"`
 }
 
 // Global config instance
@@ -28,32 +39,66 @@ func init() {
 	if err := envconfig.Process("", &cfg); err != nil {
 		log.Fatalf("Failed to process environment config: %v", err)
 	}
+	if cfg.OpenAIKey == "" {
+		log.Println("manage: OPENAI_API_KEY not set, grammar endpoint will return 503")
+	}
 }
 
 func ReviewGrammar(c *gin.Context) {
+	if cfg.OpenAIKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OPENAI_API_KEY is not configured"})
+		return
+	}
+
 	var content struct {
-		Text string `json:"text" binding:"required"`
+		Text  string `json:"text" binding:"required"`
+		Model string `json:"model"`
 	}
 
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.GrammarMaxBytes)
 	if err := c.ShouldBindJSON(&content); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Text too large: limit is %d bytes", tooLarge.Limit),
+			})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: missing or invalid text field"})
 		return
 	}
 
-	home, err := os.UserHomeDir()
+	format := c.DefaultQuery("format", "text")
+	if format != "text" && format != "diff" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be text or diff"})
+		return
+	}
+
+	if content.Model != "" && !slices.Contains(cfg.GrammarModels, content.Model) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  fmt.Sprintf("Unsupported model: %s", content.Model),
+			"models": cfg.GrammarModels,
+		})
+		return
+	}
+
+	neospellerPath, err := neospellerBinary()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to determine user home directory"})
 		return
 	}
 
-	neospellerPath := filepath.Join(home, ".local", "bin", "neospeller")
 	if _, err := os.Stat(neospellerPath); os.IsNotExist(err) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Neospeller binary not found"})
 		return
 	}
 
-	cmd := exec.Command(neospellerPath, "--lang", "text")
+	ctx := c.Request.Context()
+	cmd := exec.CommandContext(ctx, neospellerPath, "--lang", "text")
 	cmd.Env = append(os.Environ(), fmt.Sprintf("OPENAI_API_KEY=%s", cfg.OpenAIKey))
+	if content.Model != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("OPENAI_MODEL=%s", content.Model))
+	}
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -67,6 +112,10 @@ func ReviewGrammar(c *gin.Context) {
 	}()
 
 	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Neospeller did not finish in time"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": fmt.Sprintf("Neospeller execution failed: %v", err),
@@ -74,5 +123,31 @@ func ReviewGrammar(c *gin.Context) {
 		return
 	}
 
+	if format == "diff" {
+		c.JSON(http.StatusOK, gin.H{
+			"corrections": string(out),
+			"diff":        diffWords(strings.TrimSpace(content.Text), strings.TrimSpace(string(out))),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"corrections": string(out)})
 }
+
+// neospellerBinary resolves NEOSPELLER_PATH, expanding a leading "~/", and
+// defaults to ~/.local/bin/neospeller.
+func neospellerBinary() (string, error) {
+	path := cfg.NeospellerPath
+	if path != "" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return filepath.Join(home, ".local", "bin", "neospeller"), nil
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~/")), nil
+}
@@ -0,0 +1,111 @@
+package manage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReviewGrammarRejectsUnknownModel(t *testing.T) {
+	saved := cfg
+	cfg.OpenAIKey = "test-key"
+	cfg.GrammarModels = []string{"gpt-4o-mini"}
+	defer func() { cfg = saved }()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/manage/grammar",
+		strings.NewReader(`{"text":"helo world","model":"gpt-ultra"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	ReviewGrammar(c)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(rec.Body.String(), "gpt-ultra") {
+		t.Errorf("body = %s, want it to name the rejected model", rec.Body)
+	}
+}
+
+func TestReviewGrammarRejectsOversizedText(t *testing.T) {
+	saved := cfg
+	cfg.OpenAIKey = "test-key"
+	cfg.GrammarMaxBytes = 64
+	defer func() { cfg = saved }()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/manage/grammar",
+		strings.NewReader(`{"text":"`+strings.Repeat("a", 100)+`"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	ReviewGrammar(c)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestReviewGrammarRunsNeospeller(t *testing.T) {
+	// The fake neospeller echoes its stdin, so the "corrections" are the text.
+	script := filepath.Join(t.TempDir(), "neospeller")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := cfg
+	cfg.OpenAIKey = "test-key"
+	cfg.GrammarMaxBytes = 1024
+	cfg.NeospellerPath = script
+	defer func() { cfg = saved }()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/manage/grammar",
+		strings.NewReader(`{"text":"helo world"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	ReviewGrammar(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if want := `{"corrections":"helo world"}`; rec.Body.String() != want {
+		t.Errorf("body = %s, want %s", rec.Body, want)
+	}
+}
+
+func TestNeospellerBinary(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+
+	saved := cfg
+	defer func() { cfg = saved }()
+
+	tests := []struct {
+		configured string
+		want       string
+	}{
+		{configured: "", want: filepath.Join(home, ".local", "bin", "neospeller")},
+		{configured: "/opt/neospeller", want: "/opt/neospeller"},
+		{configured: "~/bin/neospeller", want: filepath.Join(home, "bin", "neospeller")},
+	}
+
+	for _, tt := range tests {
+		cfg.NeospellerPath = tt.configured
+		if got, err := neospellerBinary(); err != nil || got != tt.want {
+			t.Errorf("neospellerBinary() with %q = %q, %v, want %q", tt.configured, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultListenAddr = ":9000"
+
+// envDuration reads a Go duration (e.g. "45s") from key, falling back to def
+// when it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt64 reads a positive integer from key, falling back to def when it is
+// unset or invalid.
+func envInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// listenAddr resolves the bind address: the --addr flag when set, then
+// LISTEN_ADDR, then defaultListenAddr. It must be host:port, host optional.
+func listenAddr(flagAddr string) (string, error) {
+	addr := flagAddr
+	if addr == "" {
+		addr = os.Getenv("LISTEN_ADDR")
+	}
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid listen address %q: bad port %q", addr, port)
+	}
+	return addr, nil
+}
+
+// envFloat64 reads a non-negative number from key, falling back to def when it
+// is unset or invalid.
+func envFloat64(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Printf("Invalid %s %q, using %g", key, v, def)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,34 @@
+package server
+
+import "testing"
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: ":9000"},
+		{name: "env", env: "127.0.0.1:9100", want: "127.0.0.1:9100"},
+		{name: "flag overrides env", flag: ":9200", env: ":9100", want: ":9200"},
+		{name: "missing port", env: "localhost", wantErr: true},
+		{name: "bad port", flag: ":http-ish", wantErr: true},
+		{name: "port out of range", flag: ":70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_ADDR", tt.env)
+
+			got, err := listenAddr(tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenAddr(%q) error = %v, wantErr %v", tt.flag, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("listenAddr(%q) = %q, want %q", tt.flag, got, tt.want)
+			}
+		})
+	}
+}
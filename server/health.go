@@ -0,0 +1,31 @@
+package server
+
+import (
+	"localserver/spotify"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readiness lists what keeps the server from being ready; tests swap it.
+var readiness = spotify.Readiness
+
+// Healthz reports that the process is up. It touches nothing else, so it is
+// cheap enough for frequent uptime checks.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether the configuration and tokens needed to serve
+// requests are in place, listing the missing pieces with a 503 otherwise.
+func Readyz(c *gin.Context) {
+	if missing := readiness(); len(missing) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "not ready",
+			"missing": missing,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
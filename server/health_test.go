@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealthz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+
+	Healthz(c)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"status":"ok"}` {
+		t.Errorf("Healthz = %d %s, want 200 {\"status\":\"ok\"}", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []string
+		want    int
+		body    string
+	}{
+		{name: "ready", want: http.StatusOK, body: `{"status":"ready"}`},
+		{
+			name:    "not ready",
+			missing: []string{"no tokens for home, log in at /spotify/login?env=home"},
+			want:    http.StatusServiceUnavailable,
+			body:    `{"missing":["no tokens for home, log in at /spotify/login?env=home"],"status":"not ready"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := readiness
+			readiness = func() []string { return tt.missing }
+			defer func() { readiness = saved }()
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+
+			Readyz(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
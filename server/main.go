@@ -7,9 +7,18 @@ import (
 	"localserver/manage"
 	"localserver/spotify"
 	"log"
+	"os"
+	"time"
 )
 
-func CreateServer() {
+// CreateServer registers the routes and serves them on addr, or on
+// LISTEN_ADDR/:9000 when addr is empty.
+func CreateServer(addr string) {
+	addr, err := listenAddr(addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	log.Println("Connecting to server...")
 
 	if err := corrections.Init(context.Background()); err != nil {
@@ -17,37 +26,80 @@ func CreateServer() {
 	}
 	defer corrections.Close()
 
+	spotify.RestoreSchedules()
+
 	router := gin.Default()
 	router.SetTrustedProxies(nil)
 
+	// Probes are registered before router.Use, so the body limit, rate limit
+	// and timeout don't apply to them and a busy poller is never told 429.
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+
+	router.Use(BodyLimit(envInt64("MAX_BODY_BYTES", 1<<20)))
+	router.Use(RateLimit(envFloat64("RATE_LIMIT_RPS", 5), int(envInt64("RATE_LIMIT_BURST", 10))))
+	router.Use(Timeout(envDuration("REQUEST_TIMEOUT", 30*time.Second), map[string]time.Duration{
+		"/manage/grammar": envDuration("GRAMMAR_TIMEOUT", 60*time.Second),
+	}))
+
+	auth := BearerAuth(os.Getenv("SERVER_API_KEY"))
+
 	spotifyGroup := router.Group("/spotify")
 	{
-		// Public route without middleware
+		// Public route without middleware; Spotify's redirect to /callback
+		// can't carry the API key.
 		spotifyGroup.GET("/login", spotify.Login)
 		spotifyGroup.GET("/callback", spotify.Callback)
 
 		// Protected routes with middleware
 		protected := spotifyGroup.Group("")
-		protected.Use(spotify.SpotifyMiddleware())
+		protected.Use(auth, spotify.SpotifyMiddleware())
 		{
 			protected.GET("/play", spotify.Play)
 			protected.GET("/pause", spotify.Pause)
+			protected.GET("/next", spotify.Next)
+			protected.GET("/previous", spotify.Previous)
+			protected.GET("/seek", spotify.Seek)
+			protected.GET("/shuffle", spotify.Shuffle)
+			protected.GET("/repeat", spotify.Repeat)
 			protected.GET("/schedule", spotify.Schedule)
+			protected.GET("/schedule/cancel", spotify.CancelSchedule)
+			protected.GET("/snooze", spotify.Snooze)
 			protected.GET("/playlist", spotify.PlayPlaylist)
 			protected.GET("/search-playlist", spotify.SearchAndPlayPlaylist)
 			protected.GET("/volume", spotify.Volume)
+			protected.GET("/volume/current", spotify.CurrentVolume)
+			protected.POST("/playback-options", spotify.PlaybackOptions)
 			protected.GET("/transfer", spotify.TransferPlayback)
 			protected.GET("/devices", spotify.Devices)
+			protected.GET("/devices/transfer-and-play", spotify.TransferAndPlay)
+			protected.GET("/queue", spotify.Queue)
+			protected.GET("/queue/add", spotify.AddToQueue)
+			protected.GET("/now-playing", spotify.NowPlaying)
+			protected.GET("/save", spotify.SaveCurrent)
+			protected.GET("/recent", spotify.RecentlyPlayed)
+			protected.GET("/search", spotify.Search)
+			protected.GET("/art", spotify.Art)
+			protected.GET("/selftest", spotify.SelfTest)
+			protected.GET("/state/all", spotify.StateAll)
 		}
 	}
 
 	manageGroup := router.Group("/manage")
+	manageGroup.Use(auth)
 	{
 		manageGroup.GET("/lamp", manage.ToggleLamp)
 		manageGroup.POST("/grammar", manage.ReviewGrammar)
 	}
 
+	adminGroup := router.Group("/admin")
+	adminGroup.Use(auth)
+	{
+		adminGroup.POST("/reload", spotify.Reload)
+	}
+
 	router.GET("/corrections", corrections.List)
 
-	router.Run(":9000")
+	log.Printf("Listening on %s", addr)
+	router.Run(addr)
 }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Timeout puts a deadline on every request's context. Routes listed in
+// overrides (keyed by gin's full path) get their own budget, the rest use def.
+// Handlers must honor the context. Whatever one writes after the deadline is
+// dropped, so a handler that gives up with its own error still yields a 504.
+func Timeout(def time.Duration, overrides map[string]time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := def
+		if d, ok := overrides[c.FullPath()]; ok {
+			timeout = d
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		w := c.Writer
+		c.Writer = &deadlineWriter{ResponseWriter: w, ctx: ctx}
+		c.Next()
+		c.Writer = w
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "request timed out"})
+		}
+	}
+}
+
+// deadlineWriter discards the response once ctx is done, leaving it to
+// Timeout to answer.
+type deadlineWriter struct {
+	gin.ResponseWriter
+	ctx context.Context
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	if w.ctx.Err() == nil {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *deadlineWriter) WriteHeaderNow() {
+	if w.ctx.Err() == nil {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// BodyLimit caps every request body at max bytes. Bodies that announce a
+// larger Content-Length are rejected with 413 up front; others are cut off by
+// http.MaxBytesReader while the handler reads them. Route-specific limits
+// (e.g. /manage/grammar) apply inside this bound.
+func BodyLimit(max int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > max {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+			return
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+		}
+		c.Next()
+	}
+}
+
+// BearerAuth requires an "Authorization: Bearer <apiKey>" header and answers
+// 401 otherwise. The key is compared in constant time. An empty apiKey turns
+// the check off, so a dev setup without SERVER_API_KEY keeps working.
+func BearerAuth(apiKey string) gin.HandlerFunc {
+	if apiKey == "" {
+		log.Println("Warning: SERVER_API_KEY not set, API routes are unauthenticated")
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid bearer token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RateLimit gives each client IP a token bucket refilled at rps requests per
+// second and holding up to burst. Requests beyond it get 429 with a
+// Retry-After header. rps <= 0 disables the limit. Buckets are kept for the
+// life of the process; the clients are the few devices on the home network.
+func RateLimit(rps float64, burst int) gin.HandlerFunc {
+	if rps <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	var mu sync.Mutex
+	limiters := make(map[string]*rate.Limiter)
+
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+
+		mu.Lock()
+		limiter, ok := limiters[ip]
+		if !ok {
+			limiter = rate.NewLimiter(rate.Limit(rps), burst)
+			limiters[ip] = limiter
+		}
+		mu.Unlock()
+
+		reservation := limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
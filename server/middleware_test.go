@@ -0,0 +1,182 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// slow waits longer than any budget below unless its context is cancelled.
+	slow := func(c *gin.Context) {
+		select {
+		case <-time.After(time.Second):
+			c.JSON(http.StatusOK, gin.H{"msg": "done"})
+		case <-c.Request.Context().Done():
+		}
+	}
+
+	router := gin.New()
+	router.Use(Timeout(20*time.Millisecond, map[string]time.Duration{
+		"/patient": 2 * time.Second,
+	}))
+	router.GET("/slow", slow)
+	router.GET("/patient", slow)
+	// gaveUp reports its own error once the deadline cut its work short.
+	router.GET("/gave-up", func(c *gin.Context) {
+		<-c.Request.Context().Done()
+		c.JSON(http.StatusBadGateway, gin.H{"error": "upstream call cancelled"})
+	})
+	router.GET("/fast", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"msg": "done"})
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/slow", want: http.StatusGatewayTimeout},
+		{path: "/gave-up", want: http.StatusGatewayTimeout},
+		{path: "/patient", want: http.StatusOK},
+		{path: "/fast", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(BodyLimit(16))
+	router.POST("/echo", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.String(http.StatusOK, string(body))
+	})
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		want    int
+	}{
+		{name: "small", body: "hello", want: http.StatusOK},
+		{name: "oversized", body: strings.Repeat("x", 17), want: http.StatusRequestEntityTooLarge},
+		{name: "oversized without length", body: strings.Repeat("x", 17), chunked: true, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router := gin.New()
+	router.GET("/locked", BearerAuth("s3cret"), ok)
+	router.GET("/open", BearerAuth(""), ok)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{name: "valid token", path: "/locked", header: "Bearer s3cret", want: http.StatusOK},
+		{name: "invalid token", path: "/locked", header: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "wrong scheme", path: "/locked", header: "Basic s3cret", want: http.StatusUnauthorized},
+		{name: "missing token", path: "/locked", want: http.StatusUnauthorized},
+		{name: "no key configured", path: "/open", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const burst = 3
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router := gin.New()
+	router.GET("/limited", RateLimit(0.001, burst), ok)
+	router.GET("/unlimited", RateLimit(0, burst), ok)
+
+	request := func(path, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 1; i <= burst; i++ {
+		if rec := request("/limited", "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+
+	rec := request("/limited", "10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request %d status = %d, want %d", burst+1, rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without a Retry-After header")
+	}
+
+	// Buckets are per client.
+	if rec := request("/limited", "10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("other client status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	for i := 0; i <= burst; i++ {
+		if rec := request("/unlimited", "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("disabled limiter status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+}
@@ -2,13 +2,16 @@ package spotify
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,43 +19,57 @@ import (
 // Verify tokens and context
 func SpotifyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 
-		// Initialize
-		if envs[Home] == nil {
-			envs[Home] = new(Home)
-		}
-		if envs[Main] == nil {
-			envs[Main] = new(Main)
-		}
+		initEnvs()
 
-		reqEnv := c.Query("env")
-		deviceName, _ := url.QueryUnescape(c.Query("device_name"))
-		from, _ := url.QueryUnescape(c.Query("from"))
+		reqEnv := requestedEnv(c)
+		deviceName := queryDeviceName(c, "device_name")
+		from := queryDeviceName(c, "from")
 
 		if reqEnv != "" {
-			log.Printf("Retrieving data from env: %s", reqEnv)
-			updateEnv(envs[reqEnv])
+			logger.Debug("Retrieving data from env", "env", reqEnv)
+			env := getEnv(reqEnv)
+			if env == nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("unknown env: %s", reqEnv),
+				})
+				return
+			}
+			updateEnv(env)
 		} else if deviceName != "" {
-			if env := getEnvFromDeviceName(deviceName); env != nil {
+			if env := getEnvFromDeviceName(ctx, deviceName); env != nil {
 				updateEnv(env)
 			}
 		} else if from != "" {
-			if env := getEnvFromDeviceName(from); env != nil {
+			if env := getEnvFromDeviceName(ctx, from); env != nil {
 				updateEnv(env)
 			}
 		} else {
 			// Home as default
-			updateEnv(envs[Home])
+			updateEnv(getEnv(Home))
 		}
 
-		if _, err := currentEnv.refreshToken(); err != nil {
-			log.Printf("Error refreshing token, setting from file: %s\n", err)
+		if err := getCurrentEnv().refreshTokenIfNeeded(); err != nil {
+			logger.Warn("Error refreshing token, using the stored one", "err", err)
 		}
 
 		c.Next()
 	}
 }
 
+// envHeader lets clients pick the env without putting it in the URL.
+const envHeader = "X-Spotify-Env"
+
+// requestedEnv returns the env named by the request: the `env` query param,
+// or the X-Spotify-Env header when the param is absent.
+func requestedEnv(c *gin.Context) string {
+	if env := c.Query("env"); env != "" {
+		return env
+	}
+	return strings.TrimSpace(c.GetHeader(envHeader))
+}
+
 // Handle the login in Spotify using Client ID and Client Secret
 func Login(c *gin.Context) {
 	errMsg := "Account is incorrect. You need to pass the account type as a URL argument: env={account type}. It should be either home or main."
@@ -76,30 +93,29 @@ func Login(c *gin.Context) {
 	sp := new(Environment(environment))
 	updateEnv(sp)
 
-	scopeList := []string{
-		"user-read-playback-state",
-		"user-modify-playback-state",
-		"user-read-currently-playing",
-		"app-remote-control",
-		"user-read-recently-played",
+	// Public clients prove the login with a PKCE verifier instead of the
+	// client secret.
+	verifier, challenge := "", ""
+	if sp.UsePKCE {
+		verifier = newCodeVerifier()
+		challenge = codeChallenge(verifier)
 	}
-	scope := strings.Join(scopeList, " ")
-
-	params := url.Values{}
-	params.Set("client_id", sp.ClientId)
-	params.Set("response_type", "code")
-	params.Set("redirect_uri", sp.CallbackUri)
-	params.Set("scope", scope)
 
-	authUrl := "https://accounts.spotify.com/authorize?" + params.Encode()
-
-	c.Redirect(http.StatusTemporaryRedirect, authUrl)
+	c.Redirect(http.StatusTemporaryRedirect, sp.authorizeURL(newOAuthState(sp.Name, verifier), challenge))
 }
 
-// Handle the Spotify callback when login
+// Handle the Spotify callback when login. The state parameter must match a
+// login started by /login; it also tells which env the code belongs to.
 func Callback(c *gin.Context) {
+	login, ok := takeOAuthState(c.Query("state"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid or expired state, start again from /login",
+		})
+		return
+	}
 
-	sp := currentEnv
+	sp := getEnv(login.env)
 
 	if sp == nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -122,11 +138,15 @@ func Callback(c *gin.Context) {
 	values.Add("code", code)
 	values.Add("redirect_uri", sp.CallbackUri)
 	values.Add("client_id", sp.ClientId)
-	values.Add("client_secret", sp.ClientSecret)
+	if login.verifier != "" {
+		values.Add("code_verifier", login.verifier)
+	} else {
+		values.Add("client_secret", sp.ClientSecret)
+	}
 
 	tokenUrl := "https://accounts.spotify.com/api/token"
 
-	resp, err := http.Post(tokenUrl, "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
+	resp, err := httpClient.Post(tokenUrl, "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to request token: " + err.Error()})
 		return
@@ -134,16 +154,21 @@ func Callback(c *gin.Context) {
 
 	defer resp.Body.Close()
 
-	tokenResponse := Tokens{}
+	var tokenResponse struct {
+		Tokens
+		ExpiresIn int `json:"expires_in"`
+	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse token response: " + err.Error()})
 		return
 	}
 
-	currentEnv.tokens = &tokenResponse
+	tokens := tokenResponse.Tokens
+	tokens.ExpiresAt = expiresAt(tokenResponse.ExpiresIn)
+	sp.setTokens(&tokens)
 
-	if err := writeTokensToFile(&tokenResponse, sp.tokensFilePath); err != nil {
+	if err := writeTokensToFile(&tokens, sp.tokensFilePath); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save tokens: " + err.Error()})
 		return
 	}
@@ -153,11 +178,18 @@ func Callback(c *gin.Context) {
 	})
 }
 
+// queryDeviceName reads a device name from the query string. Gin has already
+// percent-decoded the value, so unescaping again would corrupt names holding a
+// literal '%' or '+'; only stray whitespace is trimmed.
+func queryDeviceName(c *gin.Context, key string) string {
+	return strings.TrimSpace(c.Query(key))
+}
+
 // resolveTargetDevice finds the requested device in sp's live device list. On
 // failure it writes the appropriate error response and returns ok=false, so the
 // caller can just `return`.
 func resolveTargetDevice(c *gin.Context, sp *Spotify, deviceName string) (*Device, bool) {
-	device, err := sp.deviceByName(deviceName)
+	device, err := sp.deviceByName(c.Request.Context(), deviceName)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{
 			"error": fmt.Sprintf("could not reach Spotify to resolve device: %v", err),
@@ -173,6 +205,69 @@ func resolveTargetDevice(c *gin.Context, sp *Spotify, deviceName string) (*Devic
 	return device, true
 }
 
+// guardPlayingElsewhere refuses to start playback on device while another
+// device of the same env is already playing, so a stray automation can't pull
+// the music off the speaker. force=true skips the check. On refusal it writes
+// a 409 and returns false.
+func guardPlayingElsewhere(c *gin.Context, sp *Spotify, device *Device) bool {
+	if c.Query("force") == "true" {
+		return true
+	}
+
+	playback, err := sp.getCurrentPlayback(c.Request.Context())
+	if err != nil {
+		logger.Warn("Could not read current playback, starting anyway", "err", err)
+		return true
+	}
+
+	if playback.IsPlaying && playback.Device.ID != "" && playback.Device.ID != device.ID {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("%s is already playing on %q; pass force=true to take over", sp.Name, playback.Device.Name),
+		})
+		return false
+	}
+	return true
+}
+
+// defaultDeviceName is the current env's first configured device, or "" when
+// no env has been selected yet.
+func defaultDeviceName() string {
+	sp := getCurrentEnv()
+	if sp == nil {
+		return ""
+	}
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	if len(sp.Devices) == 0 {
+		return ""
+	}
+	return sp.Devices[0].Name
+}
+
+// resolveOptionalDevice resolves the env and device for handlers whose
+// device_name is optional. Without one, the current env's active device is
+// used (empty device ID). On failure it writes the error response and returns
+// ok=false.
+func resolveOptionalDevice(c *gin.Context) (*Spotify, string, bool) {
+	deviceName := queryDeviceName(c, "device_name")
+	if deviceName == "" {
+		return getCurrentEnv(), "", true
+	}
+
+	sp := getEnvFromDeviceName(c.Request.Context(), deviceName)
+	if sp == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown device_name: %s", deviceName)})
+		return nil, "", false
+	}
+
+	device, ok := resolveTargetDevice(c, sp, deviceName)
+	if !ok {
+		return nil, "", false
+	}
+	return sp, device.ID, true
+}
+
 // playbackError reports a non-2xx Spotify playback response as an error. The
 // body must not have been consumed yet.
 func playbackError(resp *http.Response) error {
@@ -184,7 +279,8 @@ func playbackError(resp *http.Response) error {
 }
 
 func Play(c *gin.Context) {
-	deviceName := c.Query("device_name")
+	ctx := c.Request.Context()
+	deviceName := queryDeviceName(c, "device_name")
 
 	if deviceName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -193,9 +289,9 @@ func Play(c *gin.Context) {
 		return
 	}
 
-	sp := getEnvFromDeviceName(deviceName)
+	sp := getEnvFromDeviceName(ctx, deviceName)
 	if sp == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown device_name: %s", deviceName)})
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device '%s' not found in any environment", deviceName)})
 		return
 	}
 
@@ -204,7 +300,11 @@ func Play(c *gin.Context) {
 		return
 	}
 
-	resp, err := sp.playPlayback(device.ID)
+	if !guardPlayingElsewhere(c, sp, device) {
+		return
+	}
+
+	resp, err := sp.playPlayback(ctx, device.ID)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to play playback: %v", err)})
 		return
@@ -223,7 +323,8 @@ func Play(c *gin.Context) {
 }
 
 func Pause(c *gin.Context) {
-	deviceName := c.Query("device_name")
+	ctx := c.Request.Context()
+	deviceName := queryDeviceName(c, "device_name")
 
 	if deviceName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -232,9 +333,9 @@ func Pause(c *gin.Context) {
 		return
 	}
 
-	sp := getEnvFromDeviceName(deviceName)
+	sp := getEnvFromDeviceName(ctx, deviceName)
 	if sp == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown device_name: %s", deviceName)})
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("device '%s' not found in any environment", deviceName)})
 		return
 	}
 
@@ -243,7 +344,7 @@ func Pause(c *gin.Context) {
 		return
 	}
 
-	resp, err := sp.pausePlayback(device.ID)
+	resp, err := sp.pausePlayback(ctx, device.ID)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to pause playback: %v", err)})
 		return
@@ -261,6 +362,155 @@ func Pause(c *gin.Context) {
 	})
 }
 
+func Next(c *gin.Context) {
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	resp, err := sp.nextTrack(c.Request.Context(), deviceID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to skip track: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to skip track: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Skipped to next track",
+	})
+}
+
+// Previous goes back a track. Spotify's status is passed through so the caller
+// can tell whether the skip happened.
+func Previous(c *gin.Context) {
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	resp, err := sp.previousTrack(c.Request.Context(), deviceID)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to go to previous track: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":          fmt.Sprintf("failed to go to previous track: %v", err),
+			"spotify_status": resp.StatusCode,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Skipped to previous track",
+		"spotify_status": resp.StatusCode,
+	})
+}
+
+// Shuffle turns shuffle on or off and reports the state Spotify ends up in.
+func Shuffle(c *gin.Context) {
+	ctx := c.Request.Context()
+	state, err := strconv.ParseBool(c.Query("state"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be true or false"})
+		return
+	}
+
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	if err := sp.toggleShuffle(ctx, deviceID, state); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to set shuffle: %v", err)})
+		return
+	}
+
+	shuffle := state
+	if playback, err := sp.getCurrentPlayback(ctx); err == nil {
+		shuffle = playback.ShuffleState
+	} else {
+		logger.Warn("Could not read shuffle state back", "err", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"shuffle": shuffle,
+	})
+}
+
+// Repeat sets the repeat mode to track, context or off.
+func Repeat(c *gin.Context) {
+	state := c.Query("state")
+	if !validRepeatState(state) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be track, context or off"})
+		return
+	}
+
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	if err := sp.enableRepeat(c.Request.Context(), deviceID, state); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to set repeat: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"repeat": state,
+	})
+}
+
+// Seek jumps to position_ms in the current track, clamped to the track length.
+func Seek(c *gin.Context) {
+	ctx := c.Request.Context()
+	positionMs, err := strconv.Atoi(c.Query("position_ms"))
+	if err != nil || positionMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "position_ms must be a non-negative integer",
+		})
+		return
+	}
+
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	playback, err := sp.getCurrentPlayback(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to read current track: %v", err)})
+		return
+	}
+	if duration := playback.Item.DurationMs; duration > 0 && positionMs > duration {
+		positionMs = duration
+	}
+
+	resp, err := sp.seek(ctx, deviceID, positionMs)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to seek: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to seek: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Seeked successfully",
+		"position_ms": positionMs,
+	})
+}
+
 func Schedule(c *gin.Context) {
 	action := c.Query("action")
 	timeMillis := c.Query("time_millis")
@@ -272,43 +522,144 @@ func Schedule(c *gin.Context) {
 		return
 	}
 
-	var fn func()
+	days, err := parseDays(c.Query("days"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
-	switch action {
-	case "alarm":
-		fn = func() {
-			device, err := currentEnv.activeDevice()
-			if err != nil {
-				log.Printf("alarm: could not resolve device: %v", err)
-			}
-			currentEnv.playPlaylist(device, RelaxPlaylistUri, 60)
-		}
-	case "sleep":
-		fn = func() {
-			currentEnv.pausePlayback("")
+	task := scheduledTask{
+		Action:     action,
+		Env:        requestedEnv(c),
+		DeviceName: queryDeviceName(c, "device_name"),
+		Uri:        c.Query("uri"),
+		Repeat:     c.Query("repeat"),
+		Days:       days,
+	}
+	// Pin the env the middleware picked: a task restored after a restart has
+	// no current env to fall back on. A device name is still resolved when
+	// the task fires.
+	if task.Env == "" && task.DeviceName == "" {
+		if sp := getCurrentEnv(); sp != nil {
+			task.Env = sp.Name
 		}
 	}
+	if err := task.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if task.Uri != "" && !playlistAllowed(task.Uri) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("playlist %s is not in the allow-list", task.Uri),
+		})
+		return
+	}
 
 	epochMillis, err := strconv.Atoi(timeMillis)
 
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "pub_milis must be an integer",
+			"error": "time_millis must be an integer",
+		})
+		return
+	}
+
+	if err := validateScheduleDelay(time.Until(time.UnixMilli(int64(epochMillis)))); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
 		})
 		return
 	}
 
-	schedule(int64(epochMillis), fn)
+	// A recurring task starts on its first allowed day.
+	at := time.UnixMilli(int64(epochMillis))
+	if task.Repeat != "" && !task.runsOn(at.Local().Weekday()) {
+		at, _ = task.nextRun(at, at)
+	}
+
+	id := armTask(at.UnixMilli(), task)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Schedule setted successfully",
+		"id":      id,
+		"at":      at.UnixMilli(),
+	})
+}
+
+// CancelSchedule stops a pending task by the id returned from /schedule or
+// /snooze.
+func CancelSchedule(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id is required",
+		})
+		return
+	}
+
+	if !cancelTask(id) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("no pending task with id %s", id),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Schedule cancelled",
+		"id":      id,
+	})
+}
+
+// Snooze pauses the alarm that just fired and re-arms it `minutes` later
+// (default 9), up to ALARM_MAX_SNOOZES times.
+func Snooze(c *gin.Context) {
+	minutes := defaultSnoozeMinutes
+	if v := c.Query("minutes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "minutes must be a positive integer",
+			})
+			return
+		}
+		minutes = n
+	}
+
+	delay := time.Duration(minutes) * time.Minute
+	if err := validateScheduleDelay(delay); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	task, id, err := snoozeAlarm(c.Request.Context(), delay, maxSnoozes())
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Alarm snoozed for %d minutes", minutes),
+		"snoozes": task.Snoozes,
+		"id":      id,
 	})
 }
 
 func PlayPlaylist(c *gin.Context) {
+	ctx := c.Request.Context()
 	uri := c.Query("uri")
 	volumeStr := c.DefaultQuery("volume", "80")
-	deviceName := c.DefaultQuery("device_name", currentEnv.Devices[0].Name)
-	sp := getEnvFromDeviceName(deviceName)
+	deviceName := queryDeviceName(c, "device_name")
+	if deviceName == "" {
+		deviceName = defaultDeviceName()
+	}
+	sp := getEnvFromDeviceName(ctx, deviceName)
 
 	if uri == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -317,6 +668,18 @@ func PlayPlaylist(c *gin.Context) {
 		return
 	}
 
+	if !playlistAllowed(uri) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("playlist %s is not in the allow-list", uri),
+		})
+		return
+	}
+
+	if deviceName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_name is required until an environment has been selected"})
+		return
+	}
+
 	if sp == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown device_name: %s", deviceName)})
 		return
@@ -335,7 +698,11 @@ func PlayPlaylist(c *gin.Context) {
 		return
 	}
 
-	resp, err := sp.playPlaylist(device, uri, volume)
+	if !guardPlayingElsewhere(c, sp, device) {
+		return
+	}
+
+	resp, err := sp.playPlaylist(ctx, device, uri, volume)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{
 			"error": fmt.Sprintf("Error playing playlist: %v", err),
@@ -359,22 +726,24 @@ func PlayPlaylist(c *gin.Context) {
 	})
 }
 
-func SearchAndPlayPlaylist(c *gin.Context) {
-	query := c.Query("query")
-	volumeStr := c.DefaultQuery("volume", "40")
-	deviceName := c.DefaultQuery("device_name", currentEnv.Devices[0].Name)
-	sp := getEnvFromDeviceName(deviceName)
+// TransferAndPlay activates the named device, waits for Spotify to register
+// it and then starts the given context on it.
+func TransferAndPlay(c *gin.Context) {
+	ctx := c.Request.Context()
+	uri := c.Query("uri")
+	deviceName := queryDeviceName(c, "device_name")
+	volumeStr := c.DefaultQuery("volume", "50")
 
-	if query == "" {
+	if uri == "" || deviceName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "query is required",
+			"error": "uri and device_name are required",
 		})
 		return
 	}
 
-	if sp == nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("unknown device_name: %s", deviceName),
+	if !playlistAllowed(uri) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("playlist %s is not in the allow-list", uri),
 		})
 		return
 	}
@@ -387,20 +756,25 @@ func SearchAndPlayPlaylist(c *gin.Context) {
 		return
 	}
 
+	sp := getEnvFromDeviceName(ctx, deviceName)
+	if sp == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown device_name: %s", deviceName)})
+		return
+	}
+
 	device, ok := resolveTargetDevice(c, sp, deviceName)
 	if !ok {
 		return
 	}
 
-	uri, playlistName, err := sp.searchPlaylist(query)
-	if err != nil {
+	if err := sp.activateDevice(ctx, device.ID); err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{
-			"error": fmt.Sprintf("Error searching playlist: %v", err),
+			"error": fmt.Sprintf("Error activating device: %v", err),
 		})
 		return
 	}
 
-	resp, err := sp.playPlaylist(device, uri, volume)
+	resp, err := sp.playPlaylist(ctx, device, uri, volume)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{
 			"error": fmt.Sprintf("Error playing playlist: %v", err),
@@ -411,45 +785,135 @@ func SearchAndPlayPlaylist(c *gin.Context) {
 
 	if err := playbackError(resp); err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{
-			"error":    fmt.Sprintf("Spotify playback failed: %v", err),
-			"playlist": playlistName,
-			"uri":      uri,
+			"error": fmt.Sprintf("Error playing playlist: %v", err),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":     "Playlist started successfully",
-		"playlist":    playlistName,
+		"message":     "Device activated and playlist started",
 		"uri":         uri,
 		"device_name": deviceName,
-		"volume":      volume,
 	})
 }
 
-func Volume(c *gin.Context) {
-	percentage := c.Query("percentage")
+func SearchAndPlayPlaylist(c *gin.Context) {
+	ctx := c.Request.Context()
+	query := c.Query("query")
+	volumeStr := c.DefaultQuery("volume", "40")
+	deviceName := queryDeviceName(c, "device_name")
+	if deviceName == "" {
+		deviceName = defaultDeviceName()
+	}
+	sp := getEnvFromDeviceName(ctx, deviceName)
 
-	if percentage == "" {
+	if query == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "percentage is required",
+			"error": "query is required",
 		})
 		return
 	}
 
-	volume, err := strconv.Atoi(percentage)
+	if deviceName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_name is required until an environment has been selected"})
+		return
+	}
 
-	if err != nil {
-		log.Println(err)
+	if sp == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("unknown device_name: %s", deviceName),
+		})
+		return
+	}
+
+	volume, err := strconv.Atoi(volumeStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid volume value",
+		})
+		return
+	}
+
+	device, ok := resolveTargetDevice(c, sp, deviceName)
+	if !ok {
+		return
+	}
+
+	uri, playlistName, err := sp.searchPlaylist(ctx, query)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("Error searching playlist: %v", err),
+		})
+		return
+	}
+
+	if !playlistAllowed(uri) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":    fmt.Sprintf("playlist %s is not in the allow-list", uri),
+			"playlist": playlistName,
+		})
+		return
+	}
+
+	resp, err := sp.playPlaylist(ctx, device, uri, volume)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("Error playing playlist: %v", err),
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":    fmt.Sprintf("Spotify playback failed: %v", err),
+			"playlist": playlistName,
+			"uri":      uri,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Playlist started successfully",
+		"playlist":    playlistName,
+		"uri":         uri,
+		"device_name": deviceName,
+		"volume":      volume,
+	})
+}
+
+func Volume(c *gin.Context) {
+	ctx := c.Request.Context()
+	percentage := c.Query("percentage")
+
+	if percentage == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "percentage is required",
+		})
+		return
+	}
+
+	volume, err := strconv.Atoi(percentage)
+
+	if err != nil {
+		logger.Warn("Request failed", "path", c.FullPath(), "err", err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "percentage must be a number",
 		})
 		return
 	}
 
-	device, err := currentEnv.activeDevice()
+	if volume < 0 || volume > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "percentage must be between 0 and 100",
+		})
+		return
+	}
+
+	sp := getCurrentEnv()
+	device, err := sp.activeDevice(ctx)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Request failed", "path", c.FullPath(), "err", err)
 		c.JSON(http.StatusBadGateway, gin.H{
 			"error": fmt.Sprintf("could not reach Spotify to resolve device: %v", err),
 		})
@@ -462,12 +926,19 @@ func Volume(c *gin.Context) {
 		return
 	}
 
-	resp, err := currentEnv.setVolume(device.ID, volume, device.SupportsVolume)
+	resp, err := sp.setVolume(ctx, device.ID, volume, device.SupportsVolume)
 
+	if errors.Is(err, errVolumeUnsupported) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":       err.Error(),
+			"device_name": device.Name,
+		})
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+		logger.Warn("Request failed", "path", c.FullPath(), "err", err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to set volume: %v", err),
 		})
 		return
 	}
@@ -483,6 +954,465 @@ func Volume(c *gin.Context) {
 	})
 }
 
+// AddToQueue appends a track to the queue and reports the new queue length.
+func AddToQueue(c *gin.Context) {
+	ctx := c.Request.Context()
+	uri := c.Query("uri")
+	if !strings.HasPrefix(uri, "spotify:track:") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "uri must be a spotify:track: URI",
+		})
+		return
+	}
+
+	sp, deviceID, ok := resolveOptionalDevice(c)
+	if !ok {
+		return
+	}
+
+	resp, err := sp.addToQueue(ctx, deviceID, uri)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to add to queue: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to add to queue: %v", err)})
+		return
+	}
+
+	userQueue, err := sp.getUserQueue(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("track queued but failed to read the queue: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Track added to queue",
+		"uri":          uri,
+		"queue_length": len(userQueue.Queue),
+	})
+}
+
+// NowPlaying reports the current env's track. When nothing is playing
+// (Spotify answers 204) it returns {"playing": false} with a 200, so pollers
+// don't treat an idle player as an error.
+func NowPlaying(c *gin.Context) {
+	playback, err := getCurrentEnv().getCurrentPlayback(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to get current playback: %v", err),
+		})
+		return
+	}
+
+	if playback.Item.Uri == "" {
+		c.JSON(http.StatusOK, gin.H{"playing": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"track":        playback.Item.Name,
+		"artist":       artistNames(playback.Item),
+		"progress_ms":  playback.ProgressMs,
+		"duration_ms":  playback.Item.DurationMs,
+		"is_playing":   playback.IsPlaying,
+		"device":       playback.Device.Name,
+		"display_name": displayName(playback.Device.Name),
+	})
+}
+
+// SaveCurrent adds the playing track to the user's Liked Songs.
+func SaveCurrent(c *gin.Context) {
+	ctx := c.Request.Context()
+	sp := getCurrentEnv()
+	playback, err := sp.getCurrentPlayback(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to get current playback: %v", err),
+		})
+		return
+	}
+
+	if playback.Item.Uri == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "nothing is playing"})
+		return
+	}
+
+	id, err := parseTrackId(playback.Item.Uri)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("only tracks can be saved, playing %s", playback.Item.Uri),
+		})
+		return
+	}
+
+	resp, err := sp.saveTracks(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to save track: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := playbackError(resp); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to save track: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Track saved",
+		"track":   playback.Item.Name,
+		"uri":     playback.Item.Uri,
+	})
+}
+
+// Queue returns the currently playing track and at most `limit` upcoming
+// items (default 20) from the user's queue.
+func Queue(c *gin.Context) {
+	limit := defaultQueueLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "limit must be a non-negative integer",
+			})
+			return
+		}
+		limit = n
+	}
+
+	userQueue, err := getCurrentEnv().getUserQueue(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to get user queue: %v", err),
+		})
+		return
+	}
+
+	queue := limitQueue(userQueue.Queue, limit)
+	if queue == nil {
+		queue = []Track{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"currently_playing": userQueue.CurrentlyPlaying,
+		"queue":             queue,
+		"limit":             limit,
+	})
+}
+
+// Search returns the name and URI of the results matching `q`, of `type`
+// track (default), playlist or album.
+func Search(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+
+	searchType := c.DefaultQuery("type", "track")
+	if !slices.Contains(searchTypes, searchType) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("type must be one of %s", strings.Join(searchTypes, ", ")),
+		})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit must be an integer between 1 and %d", maxSearchLimit),
+			})
+			return
+		}
+		limit = n
+	}
+
+	results, err := getCurrentEnv().search(c.Request.Context(), query, searchType, limit)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to search: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"type":    searchType,
+		"results": results,
+	})
+}
+
+// RecentlyPlayed returns the last `limit` tracks played, newest first.
+func RecentlyPlayed(c *gin.Context) {
+	limit := defaultRecentLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecentLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit must be an integer between 1 and %d", maxRecentLimit),
+			})
+			return
+		}
+		limit = n
+	}
+
+	recent, err := getCurrentEnv().getRecentlyPlayed(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to get recently played tracks: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tracks": summarizeRecent(recent),
+		"limit":  limit,
+	})
+}
+
+// Art returns the cover image URL of the currently playing track, picking the
+// image closest to the optional `size` (pixels); the largest by default.
+func Art(c *gin.Context) {
+	size := 0
+	if v := c.Query("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "size must be a positive integer",
+			})
+			return
+		}
+		size = n
+	}
+
+	playback, err := getCurrentEnv().getCurrentPlayback(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("failed to get current playback: %v", err),
+		})
+		return
+	}
+
+	image := closestImage(playback.Item.Album.Images, size)
+	if image == nil {
+		c.JSON(http.StatusOK, gin.H{"playing": playback.IsPlaying, "url": nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"playing": playback.IsPlaying,
+		"track":   playback.Item.Name,
+		"url":     image.URL,
+		"width":   image.Width,
+		"height":  image.Height,
+	})
+}
+
+// CurrentVolume reports the active device's volume so a client can sync its
+// slider without parsing the full playback state.
+func CurrentVolume(c *gin.Context) {
+	sp := getCurrentEnv()
+	device, err := sp.activeDevice(c.Request.Context())
+	if err != nil {
+		logger.Warn("Request failed", "path", c.FullPath(), "err", err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("could not reach Spotify to resolve device: %v", err),
+		})
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusFailedDependency, gin.H{
+			"error": "no reachable device to read volume from",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_name":     device.Name,
+		"display_name":    displayName(device.Name),
+		"volume_percent":  device.VolumenPercent,
+		"supports_volume": device.SupportsVolume,
+	})
+}
+
+// stepResult reports one step of a multi-step endpoint.
+type stepResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SelfTest checks that an environment is healthy after a deploy: it refreshes
+// the token, lists devices and reads the current playback, reporting each step.
+// It never starts, pauses or transfers playback. Returns 503 if any step fails.
+func SelfTest(c *gin.Context) {
+	ctx := c.Request.Context()
+	name := requestedEnv(c)
+	if name == "" {
+		name = Home
+	}
+	sp := getEnv(name)
+	if sp == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("unknown env: %s", name),
+		})
+		return
+	}
+
+	steps := make([]stepResult, 0, 3)
+	record := func(step string, err error, detail string) {
+		if err != nil {
+			detail = err.Error()
+		}
+		steps = append(steps, stepResult{Name: step, OK: err == nil, Detail: detail})
+	}
+
+	_, err := sp.refreshToken()
+	record("token", err, "refreshed")
+
+	devices, err := sp.fetchDevices(ctx)
+	record("devices", err, fmt.Sprintf("%d reachable", len(devices)))
+
+	playback, err := sp.getCurrentPlayback(ctx)
+	detail := "idle"
+	if err == nil && playback.IsPlaying {
+		detail = fmt.Sprintf("playing %q on %s", playback.Item.Name, playback.Device.Name)
+	}
+	record("playback", err, detail)
+
+	status := http.StatusOK
+	for _, step := range steps {
+		if !step.OK {
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	c.JSON(status, gin.H{
+		"environment": name,
+		"passed":      status == http.StatusOK,
+		"steps":       steps,
+	})
+}
+
+// StateAll fetches the current playback of every environment concurrently and
+// returns env -> summary. A failing env reports its error without hiding the
+// others.
+func StateAll(c *gin.Context) {
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	snapshot := allEnvs()
+	states := make(map[string]playbackSummary, len(snapshot))
+
+	for name, env := range snapshot {
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := env.refreshTokenIfNeeded(); err != nil {
+				logger.Warn("StateAll: failed to refresh token", "env", name, "err", err)
+			}
+
+			var summary playbackSummary
+			if playback, err := env.getCurrentPlayback(c.Request.Context()); err != nil {
+				summary.Error = err.Error()
+			} else {
+				summary = summarizePlayback(playback)
+			}
+
+			mu.Lock()
+			states[name] = summary
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{
+		"environments": states,
+	})
+}
+
+// PlaybackOptions applies a saved preset of {shuffle, repeat, volume} to the
+// active device in that order, reporting each step. Omitted fields are left
+// untouched. Everything is validated before any change is made.
+func PlaybackOptions(c *gin.Context) {
+	ctx := c.Request.Context()
+	var options struct {
+		Shuffle *bool   `json:"shuffle"`
+		Repeat  *string `json:"repeat"`
+		Volume  *int    `json:"volume"`
+	}
+
+	if err := c.ShouldBindJSON(&options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if options.Repeat != nil && !validRepeatState(*options.Repeat) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repeat must be track, context or off"})
+		return
+	}
+	if options.Volume != nil && (*options.Volume < 0 || *options.Volume > 100) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "volume must be between 0 and 100"})
+		return
+	}
+
+	sp := getCurrentEnv()
+	device, err := sp.activeDevice(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("could not reach Spotify to resolve device: %v", err),
+		})
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusFailedDependency, gin.H{"error": "no reachable device to apply options to"})
+		return
+	}
+
+	var steps []stepResult
+	record := func(name string, err error) {
+		step := stepResult{Name: name, OK: err == nil}
+		if err != nil {
+			step.Detail = err.Error()
+		}
+		steps = append(steps, step)
+	}
+
+	if options.Shuffle != nil {
+		record("shuffle", sp.toggleShuffle(ctx, device.ID, *options.Shuffle))
+	}
+	if options.Repeat != nil {
+		record("repeat", sp.enableRepeat(ctx, device.ID, *options.Repeat))
+	}
+	if options.Volume != nil {
+		resp, err := sp.setVolume(ctx, device.ID, *options.Volume, device.SupportsVolume)
+		if err == nil {
+			err = playbackError(resp)
+			resp.Body.Close()
+		}
+		record("volume", err)
+	}
+
+	status := http.StatusOK
+	for _, step := range steps {
+		if !step.OK {
+			status = http.StatusBadGateway
+			break
+		}
+	}
+
+	c.JSON(status, gin.H{
+		"device_name": device.Name,
+		"steps":       steps,
+	})
+}
+
 // Devices returns every reachable device grouped by environment. It refreshes
 // each environment's token and queries Spotify for all available devices,
 // regardless of whether one is actively playing.
@@ -492,24 +1422,33 @@ func Devices(c *gin.Context) {
 		Devices     []Device `json:"devices"`
 	}
 
-	environments := make([]envDevices, 0, len(envs))
-
-	for name, env := range envs {
-		if env == nil {
-			continue
+	snapshot := allEnvs()
+	if name := requestedEnv(c); name != "" {
+		sp, ok := snapshot[name]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown env: %s", name)})
+			return
 		}
+		snapshot = map[string]*Spotify{name: sp}
+	}
+	environments := make([]envDevices, 0, len(snapshot))
 
-		if _, err := env.refreshToken(); err != nil {
-			log.Printf("Devices: failed to refresh token for %s: %s", name, err)
+	for name, env := range snapshot {
+
+		if err := env.refreshTokenIfNeeded(); err != nil {
+			logger.Warn("Devices: failed to refresh token", "env", name, "err", err)
 		}
 
-		devices, err := env.fetchDevices()
+		devices, err := env.fetchDevices(c.Request.Context())
 		if err != nil {
-			log.Printf("Devices: failed to fetch devices for %s: %s", name, err)
+			logger.Warn("Devices: failed to fetch devices", "env", name, "err", err)
 		}
 		if devices == nil {
 			devices = []Device{}
 		}
+		for i := range devices {
+			devices[i].DisplayName = displayName(devices[i].Name)
+		}
 
 		environments = append(environments, envDevices{
 			Environment: name,
@@ -523,7 +1462,8 @@ func Devices(c *gin.Context) {
 }
 
 func TransferPlayback(c *gin.Context) {
-	toName := c.Query("to")
+	ctx := c.Request.Context()
+	toName := queryDeviceName(c, "to")
 	volumeStr := c.DefaultQuery("volume", "0")
 
 	volume, err := strconv.Atoi(volumeStr)
@@ -541,8 +1481,8 @@ func TransferPlayback(c *gin.Context) {
 		return
 	}
 
-	from := currentEnv
-	to := getEnvFromDeviceName(toName)
+	from := getCurrentEnv()
+	to := getEnvFromDeviceName(ctx, toName)
 
 	if from == nil || to == nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -551,8 +1491,8 @@ func TransferPlayback(c *gin.Context) {
 		return
 	}
 
-	if _, err := to.refreshToken(); err != nil {
-		log.Printf("Error refreshing token, setting from file: %s\n", err)
+	if err := to.refreshTokenIfNeeded(); err != nil {
+		logger.Warn("Error refreshing token, using the stored one", "err", err)
 	}
 
 	toDevice, ok := resolveTargetDevice(c, to, toName)
@@ -563,14 +1503,14 @@ func TransferPlayback(c *gin.Context) {
 	// Librespot does not allow playing a queue directly.
 	// For it, i need to transfer the current song and schedule the playlist.
 	if toName == "librespot" || toName == "iPhone" {
-		err = from.hardTransferPlayback(to, toDevice, volume)
+		err = from.hardTransferPlayback(ctx, to, toDevice, volume)
 	} else {
 		// TODO: Evaluate whether this is necessary; if not, remove it.
-		err = from.transferPlayback(to, toDevice)
+		err = from.transferPlayback(ctx, to, toDevice, c.Query("fade") == "true")
 	}
 
 	if err != nil {
-		log.Printf("Error transferring callback: %s", err)
+		logger.Error("Error transferring playback", "err", err)
 		c.JSON(http.StatusBadGateway, gin.H{
 			"error": fmt.Sprintf("error transfering playback: %s", err),
 		})
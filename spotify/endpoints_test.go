@@ -1,33 +1,86 @@
 package spotify
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/semaphore"
 )
 
+// rewriteTransport sends every request to the test server, keeping the
+// original path and query so fakes can route on them.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeSpotify points the package HTTP client at handler for the rest of the
+// test, so no request ever reaches the real Spotify API.
+func fakeSpotify(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := httpClient
+	httpClient = &http.Client{Transport: rewriteTransport{target: target}}
+	t.Cleanup(func() {
+		httpClient = saved
+		srv.Close()
+	})
+}
+
+// useEnvs swaps in all as the environments, with the one named current as the
+// current env ("" for none), and restores both when the test ends.
+func useEnvs(t *testing.T, all map[string]*Spotify, current string) {
+	t.Helper()
+
+	if all == nil {
+		all = map[string]*Spotify{}
+	}
+	savedEnvs, savedCurrent := envs, currentEnv
+	envs, currentEnv = all, all[current]
+	t.Cleanup(func() { envs, currentEnv = savedEnvs, savedCurrent })
+}
+
 func TestFetchDevicesNilTokens(t *testing.T) {
 	sp := &Spotify{Name: "home"}
-	if _, err := sp.fetchDevices(); err == nil {
+	if _, err := sp.fetchDevices(t.Context()); err == nil {
 		t.Fatal("fetchDevices() with nil tokens = nil error, want error")
 	}
 }
 
 func TestDeviceByNameNilTokens(t *testing.T) {
 	sp := &Spotify{Name: "main"}
-	if _, err := sp.deviceByName("MacBook Air de Richard"); err == nil {
+	if _, err := sp.deviceByName(t.Context(), "MacBook Air de Richard"); err == nil {
 		t.Fatal("deviceByName() with nil tokens = nil error, want error")
 	}
 }
 
 func TestGetEnvFromDeviceNameAcceptsCheckrMacBook(t *testing.T) {
-	saved := envs
-	envs = map[string]*Spotify{
+	useEnvs(t, map[string]*Spotify{
 		string(Main): {
 			Name:    string(Main),
 			Devices: []Device{{Name: "iPhone"}, {Name: "MacBook Air de Richard"}, {Name: "MD3HKDVJW4"}},
@@ -36,10 +89,9 @@ func TestGetEnvFromDeviceNameAcceptsCheckrMacBook(t *testing.T) {
 			Name:    string(Home),
 			Devices: []Device{{Name: "librespot"}},
 		},
-	}
-	defer func() { envs = saved }()
+	}, "")
 
-	got := getEnvFromDeviceName("MD3HKDVJW4")
+	got := getEnvFromDeviceName(t.Context(), "MD3HKDVJW4")
 	if got == nil {
 		t.Fatal("getEnvFromDeviceName() returned nil, want main environment")
 	}
@@ -120,9 +172,7 @@ func TestPlayRequiresDeviceName(t *testing.T) {
 
 func TestDevicesEndpointEmptyEnvs(t *testing.T) {
 	// Isolate the package-global env map and restore it afterwards.
-	saved := envs
-	envs = make(map[string]*Spotify)
-	defer func() { envs = saved }()
+	useEnvs(t, nil, "")
 
 	gin.SetMode(gin.TestMode)
 	rec := httptest.NewRecorder()
@@ -149,3 +199,1923 @@ func TestDevicesEndpointEmptyEnvs(t *testing.T) {
 		t.Errorf("environments = %v, want empty", body.Environments)
 	}
 }
+
+func TestPlayPlaylistRejectsURIOutsideAllowList(t *testing.T) {
+	t.Setenv("PLAYLIST_ALLOWLIST", "spotify:playlist:allowed")
+
+	useEnvs(t, map[string]*Spotify{string(Home): {Name: string(Home), Devices: []Device{{Name: "librespot"}}}}, string(Home))
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/playlist?uri=spotify:playlist:blocked", nil)
+
+	PlayPlaylist(c)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestCurrentVolume(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/me/player/devices" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		io.WriteString(w, `{"devices":[
+			{"id":"a","name":"iPhone","is_active":false,"volume_percent":100,"supports_volume":false},
+			{"id":"b","name":"librespot","is_active":true,"volume_percent":35,"supports_volume":true}
+		]}`)
+	})
+
+	useEnvs(t, map[string]*Spotify{string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "token"}}}, string(Home))
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/volume/current", nil)
+
+	CurrentVolume(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body struct {
+		DeviceName     string `json:"device_name"`
+		VolumePercent  int    `json:"volume_percent"`
+		SupportsVolume bool   `json:"supports_volume"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+
+	if body.DeviceName != "librespot" || body.VolumePercent != 35 || !body.SupportsVolume {
+		t.Errorf("body = %+v, want the active librespot device at 35%%", body)
+	}
+}
+
+func TestGetCurrentPlaybackRetriesOnServerError(t *testing.T) {
+	savedDelay := playbackRetryDelay
+	playbackRetryDelay = 0
+	defer func() { playbackRetryDelay = savedDelay }()
+
+	calls := 0
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, `{"is_playing":true,"progress_ms":1200,"device":{"name":"librespot"}}`)
+	})
+
+	sp := &Spotify{Name: string(Home), tokens: &Tokens{AccessToken: "token"}}
+	playback, err := sp.getCurrentPlayback(t.Context())
+	if err != nil {
+		t.Fatalf("getCurrentPlayback() error = %v, want nil after retry", err)
+	}
+	if calls != 2 {
+		t.Errorf("requests = %d, want 2", calls)
+	}
+	if !playback.IsPlaying || playback.Device.Name != "librespot" {
+		t.Errorf("playback = %+v, want librespot playing", playback)
+	}
+}
+
+func TestGetCurrentPlaybackDoesNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	sp := &Spotify{Name: string(Home), tokens: &Tokens{AccessToken: "token"}}
+	if _, err := sp.getCurrentPlayback(t.Context()); err == nil {
+		t.Fatal("getCurrentPlayback() error = nil, want error on 403")
+	}
+	if calls != 1 {
+		t.Errorf("requests = %d, want 1", calls)
+	}
+}
+
+// Names with spaces and accents arrive percent-encoded; they must resolve to
+// the same device as the plain name.
+func TestPlayResolvesEncodedDeviceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  string
+		encoded string
+	}{
+		{name: "spaces", device: "MacBook Air de Richard", encoded: "MacBook%20Air%20de%20Richard"},
+		{name: "plus as space", device: "MacBook Air de Richard", encoded: "MacBook+Air+de+Richard"},
+		{name: "accents", device: "Habitación", encoded: "Habitaci%C3%B3n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var playedOn string
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/me/player/devices":
+					json.NewEncoder(w).Encode(map[string]any{
+						"devices": []Device{{ID: "dev-1", Name: tt.device}},
+					})
+				case "/v1/me/player":
+					w.WriteHeader(http.StatusNoContent)
+				case "/v1/me/player/play":
+					playedOn = r.URL.Query().Get("device_id")
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected request to %s", r.URL.Path)
+				}
+			})
+
+			useEnvs(t, map[string]*Spotify{
+				string(Main): {
+					Name:    string(Main),
+					Devices: []Device{{Name: tt.device}},
+					tokens:  &Tokens{AccessToken: "token"},
+				},
+			}, "")
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/play?device_name="+tt.encoded, nil)
+
+			Play(c)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			if playedOn != "dev-1" {
+				t.Errorf("played on device_id %q, want %q", playedOn, "dev-1")
+			}
+		})
+	}
+}
+
+func TestDevicesEndpointReturnsDisplayNames(t *testing.T) {
+	t.Setenv("DEVICE_ALIASES", "librespot=Living Room, iPhone = Phone")
+
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"devices":[{"id":"a","name":"librespot"},{"id":"b","name":"Kitchen"}]}`)
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Home): {
+			Name:    string(Home),
+			Devices: []Device{{Name: "librespot"}},
+			tokens:  &Tokens{AccessToken: "token"},
+		},
+	}, "")
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/devices", nil)
+
+	Devices(c)
+
+	var body struct {
+		Environments []struct {
+			Devices []Device `json:"devices"`
+		} `json:"environments"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(body.Environments) != 1 || len(body.Environments[0].Devices) != 2 {
+		t.Fatalf("environments = %+v, want one env with two devices", body.Environments)
+	}
+
+	devices := body.Environments[0].Devices
+	if devices[0].Name != "librespot" || devices[0].DisplayName != "Living Room" {
+		t.Errorf("device[0] = %+v, want raw name librespot shown as Living Room", devices[0])
+	}
+	if devices[1].DisplayName != "Kitchen" {
+		t.Errorf("device[1].DisplayName = %q, want raw name as fallback", devices[1].DisplayName)
+	}
+
+	// Resolution keeps using the raw name.
+	if getEnvFromDeviceName(t.Context(), "librespot") == nil {
+		t.Error("getEnvFromDeviceName(raw name) = nil, want home env")
+	}
+	if getEnvFromDeviceName(t.Context(), "Living Room") != nil {
+		t.Error("getEnvFromDeviceName(alias) resolved, want nil")
+	}
+}
+
+func TestScheduleRejectsOutOfRangeTimes(t *testing.T) {
+	tests := []struct {
+		name   string
+		millis int64
+	}{
+		{name: "past", millis: time.Now().Add(-time.Hour).UnixMilli()},
+		{name: "over horizon", millis: time.Now().Add(365 * 24 * time.Hour).UnixMilli()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet,
+				fmt.Sprintf("/spotify/schedule?action=sleep&time_millis=%d", tt.millis), nil)
+
+			Schedule(c)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestMakeRequestLimitsConcurrency(t *testing.T) {
+	const limit = 2
+
+	outboundLimiter() // make sure the lazy init can't overwrite the test limiter
+	saved := outboundSem
+	outboundSem = semaphore.NewWeighted(limit)
+	defer func() { outboundSem = saved }()
+
+	var inFlight, maxInFlight atomic.Int32
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	sp := &Spotify{Name: string(Home), tokens: &Tokens{AccessToken: "token"}}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := sp.makeRequest(t.Context(), "PUT", PlayEndpoint)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got > limit {
+		t.Errorf("max concurrent requests = %d, want <= %d", got, limit)
+	}
+}
+
+func TestVolumeDistinguishesUnsupportedDevices(t *testing.T) {
+	tests := []struct {
+		name           string
+		supportsVolume bool
+		wantStatus     int
+		wantVolumeCall bool
+	}{
+		{name: "supports volume", supportsVolume: true, wantStatus: http.StatusOK, wantVolumeCall: true},
+		{name: "no volume support", supportsVolume: false, wantStatus: http.StatusUnprocessableEntity, wantVolumeCall: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeCalled := false
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/me/player/devices":
+					json.NewEncoder(w).Encode(map[string]any{
+						"devices": []Device{{ID: "d", Name: "iPhone", IsActive: true, SupportsVolume: tt.supportsVolume}},
+					})
+				case "/v1/me/player/volume":
+					volumeCalled = true
+					w.WriteHeader(http.StatusNoContent)
+				}
+			})
+
+			useEnvs(t, map[string]*Spotify{string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "token"}}}, string(Main))
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/volume?percentage=40", nil)
+
+			Volume(c)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if volumeCalled != tt.wantVolumeCall {
+				t.Errorf("volume endpoint called = %v, want %v", volumeCalled, tt.wantVolumeCall)
+			}
+		})
+	}
+}
+
+func TestVolumeRange(t *testing.T) {
+	var gotVolume string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player/devices":
+			json.NewEncoder(w).Encode(map[string]any{
+				"devices": []Device{{ID: "d", Name: "iPhone", IsActive: true, SupportsVolume: true}},
+			})
+		case "/v1/me/player/volume":
+			gotVolume = r.URL.Query().Get("volume_percent")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "token"}}}, string(Main))
+
+	tests := []struct {
+		percentage string
+		wantStatus int
+	}{
+		{percentage: "-1", wantStatus: http.StatusBadRequest},
+		{percentage: "0", wantStatus: http.StatusOK},
+		{percentage: "100", wantStatus: http.StatusOK},
+		{percentage: "101", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		gotVolume = ""
+
+		gin.SetMode(gin.TestMode)
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodGet, "/spotify/volume?percentage="+tt.percentage, nil)
+
+		Volume(c)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("percentage=%s: status = %d, want %d: %s", tt.percentage, rec.Code, tt.wantStatus, rec.Body)
+		}
+		wantVolume := ""
+		if tt.wantStatus == http.StatusOK {
+			wantVolume = tt.percentage
+		}
+		if gotVolume != wantVolume {
+			t.Errorf("percentage=%s: Spotify volume = %q, want %q", tt.percentage, gotVolume, wantVolume)
+		}
+	}
+}
+
+func TestHandlerGivesUpAtDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "slow response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			name: "rate limited",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+		},
+	}
+
+	useEnvs(t, map[string]*Spotify{string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "token"}}}, string(Main))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSpotify(t, tt.handler)
+
+			ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+			defer cancel()
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodPost, "/spotify/next", nil).WithContext(ctx)
+
+			start := time.Now()
+			Next(c)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Next() took %v after a 50ms deadline", elapsed)
+			}
+			if rec.Code == http.StatusOK {
+				t.Errorf("status = %d, want an error once the deadline passed", rec.Code)
+			}
+		})
+	}
+}
+
+func TestSetVolumeClamps(t *testing.T) {
+	var gotVolume string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		gotVolume = r.URL.Query().Get("volume_percent")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	sp := &Spotify{Name: string(Main), tokens: &Tokens{AccessToken: "token"}}
+
+	tests := []struct {
+		volume int
+		want   string
+	}{
+		{volume: -1, want: "0"},
+		{volume: 0, want: "0"},
+		{volume: 100, want: "100"},
+		{volume: 101, want: "100"},
+	}
+
+	for _, tt := range tests {
+		resp, err := sp.setVolume(t.Context(), "d", tt.volume, true)
+		if err != nil {
+			t.Fatalf("setVolume(%d) error = %v", tt.volume, err)
+		}
+		resp.Body.Close()
+
+		if gotVolume != tt.want {
+			t.Errorf("setVolume(%d) sent %q, want %q", tt.volume, gotVolume, tt.want)
+		}
+	}
+}
+
+func TestTransferPlaybackFadesBothDevices(t *testing.T) {
+	savedDuration := handoffDuration
+	handoffDuration = 0
+	defer func() { handoffDuration = savedDuration }()
+
+	var mu sync.Mutex
+	volumes := map[string][]string{}
+	var pausedDevice string
+
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/me/player":
+			io.WriteString(w, `{"is_playing":true,"progress_ms":5000,
+				"device":{"id":"src","name":"MacBook Air de Richard","volume_percent":60,"supports_volume":true}}`)
+		case "/v1/me/player/queue":
+			io.WriteString(w, `{"currently_playing":{"uri":"spotify:track:a"},"queue":[{"uri":"spotify:track:b"}]}`)
+		case "/v1/me/player/volume":
+			id := r.URL.Query().Get("device_id")
+			volumes[id] = append(volumes[id], r.URL.Query().Get("volume_percent"))
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/me/player/pause":
+			pausedDevice = r.URL.Query().Get("device_id")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/me/player/play":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	from := &Spotify{Name: string(Main), tokens: &Tokens{AccessToken: "main"}}
+	to := &Spotify{Name: string(Home), tokens: &Tokens{AccessToken: "home"}}
+
+	err := from.transferPlayback(t.Context(), to, &Device{ID: "dst", Name: "librespot", SupportsVolume: true}, true)
+	if err != nil {
+		t.Fatalf("transferPlayback() error = %v", err)
+	}
+
+	src, dst := volumes["src"], volumes["dst"]
+	// Source: fadeSteps steps down to 0, then its volume is restored.
+	if len(src) != fadeSteps+1 || src[fadeSteps-1] != "0" || src[fadeSteps] != "60" {
+		t.Errorf("source volumes = %v, want a ramp to 0 then restore to 60", src)
+	}
+	// Destination: muted first, then fadeSteps steps up to the source volume.
+	if len(dst) != fadeSteps+1 || dst[0] != "0" || dst[fadeSteps] != "60" {
+		t.Errorf("destination volumes = %v, want mute then a ramp to 60", dst)
+	}
+	if pausedDevice != "src" {
+		t.Errorf("paused device = %q, want src", pausedDevice)
+	}
+}
+
+func TestTransferPlaybackSkipsFadeWithinOneEnv(t *testing.T) {
+	var mu sync.Mutex
+	var volumeCalls int
+	var playedDevice string
+
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/me/player":
+			io.WriteString(w, `{"is_playing":true,"progress_ms":5000,
+				"device":{"id":"src","name":"iPhone","volume_percent":60,"supports_volume":true}}`)
+		case "/v1/me/player/queue":
+			io.WriteString(w, `{"currently_playing":{"uri":"spotify:track:a"},"queue":[{"uri":"spotify:track:b"}]}`)
+		case "/v1/me/player/volume":
+			volumeCalls++
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/me/player/pause":
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/me/player/play":
+			playedDevice = r.URL.Query().Get("device_id")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	sp := &Spotify{Name: string(Main), tokens: &Tokens{AccessToken: "main"}}
+
+	err := sp.transferPlayback(t.Context(), sp, &Device{ID: "dst", Name: "MacBook Air de Richard", SupportsVolume: true}, true)
+	if err != nil {
+		t.Fatalf("transferPlayback() error = %v", err)
+	}
+
+	if volumeCalls != 0 {
+		t.Errorf("volume requests = %d, want no fade within one env", volumeCalls)
+	}
+	if playedDevice != "dst" {
+		t.Errorf("played on device_id %q, want dst", playedDevice)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     *Tokens
+		wantStatus int
+		wantOK     []bool
+	}{
+		{
+			name:       "healthy env",
+			tokens:     &Tokens{AccessToken: "old", RefreshToken: "refresh"},
+			wantStatus: http.StatusOK,
+			wantOK:     []bool{true, true, true},
+		},
+		{
+			name:       "no tokens",
+			tokens:     nil,
+			wantStatus: http.StatusServiceUnavailable,
+			wantOK:     []bool{false, false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/token":
+					io.WriteString(w, `{"access_token":"new","expires_in":3600}`)
+				case "/v1/me/player/devices":
+					io.WriteString(w, `{"devices":[{"id":"a","name":"librespot"}]}`)
+				case "/v1/me/player":
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+				}
+			})
+
+			useEnvs(t, map[string]*Spotify{
+				string(Home): {
+					Name:           string(Home),
+					tokens:         tt.tokens,
+					tokensFilePath: t.TempDir() + "/tokens.txt",
+				},
+			}, "")
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/selftest?env=home", nil)
+
+			SelfTest(c)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			var body struct {
+				Steps []stepResult `json:"steps"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unmarshal response: %v", err)
+			}
+			if len(body.Steps) != len(tt.wantOK) {
+				t.Fatalf("steps = %+v, want %d steps", body.Steps, len(tt.wantOK))
+			}
+			for i, step := range body.Steps {
+				if step.OK != tt.wantOK[i] {
+					t.Errorf("step %s ok = %v, want %v (%s)", step.Name, step.OK, tt.wantOK[i], step.Detail)
+				}
+			}
+		})
+	}
+}
+
+func TestSelfTestUnknownEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		header string
+	}{
+		{name: "query param", query: "?env=office"},
+		{name: "header", header: "office"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/selftest"+tt.query, nil)
+			if tt.header != "" {
+				c.Request.Header.Set(envHeader, tt.header)
+			}
+
+			SelfTest(c)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestStateAll(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/token":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/v1/me/player":
+			if r.Header.Get("Authorization") == "Bearer main" {
+				io.WriteString(w, `{"is_playing":true,"progress_ms":1000,
+					"device":{"name":"iPhone"},"item":{"name":"Song","uri":"spotify:track:1","duration_ms":180000}}`)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main"}},
+		string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "home"}},
+	}, "")
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/state/all", nil)
+
+	StateAll(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var body struct {
+		Environments map[string]playbackSummary `json:"environments"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+
+	main, home := body.Environments[string(Main)], body.Environments[string(Home)]
+	if !main.IsPlaying || main.Track != "Song" || main.Device != "iPhone" || main.DurationMs != 180000 {
+		t.Errorf("main = %+v, want Song playing on iPhone", main)
+	}
+	if home.IsPlaying || home.Error != "" {
+		t.Errorf("home = %+v, want idle without error", home)
+	}
+}
+
+func TestPlaybackOptions(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/me/player/devices":
+			io.WriteString(w, `{"devices":[{"id":"d","name":"librespot","is_active":true,"supports_volume":true}]}`)
+			return
+		case "/v1/me/player/repeat":
+			order = append(order, "repeat="+r.URL.Query().Get("state"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "/v1/me/player/shuffle":
+			order = append(order, "shuffle="+r.URL.Query().Get("state"))
+		case "/v1/me/player/volume":
+			order = append(order, "volume="+r.URL.Query().Get("volume_percent"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	useEnvs(t, map[string]*Spotify{string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "token"}}}, string(Home))
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/spotify/playback-options",
+		strings.NewReader(`{"shuffle":true,"repeat":"off","volume":30}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	PlaybackOptions(c)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d for a partial failure", rec.Code, http.StatusBadGateway)
+	}
+
+	wantOrder := []string{"shuffle=true", "repeat=off", "volume=30"}
+	if strings.Join(order, ",") != strings.Join(wantOrder, ",") {
+		t.Errorf("applied %v, want %v", order, wantOrder)
+	}
+
+	var body struct {
+		Steps []stepResult `json:"steps"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	wantOK := map[string]bool{"shuffle": true, "repeat": false, "volume": true}
+	if len(body.Steps) != len(wantOK) {
+		t.Fatalf("steps = %+v, want 3", body.Steps)
+	}
+	for _, step := range body.Steps {
+		if step.OK != wantOK[step.Name] {
+			t.Errorf("step %s ok = %v, want %v", step.Name, step.OK, wantOK[step.Name])
+		}
+	}
+}
+
+func TestPlaybackOptionsValidation(t *testing.T) {
+	for _, body := range []string{`{"repeat":"forever"}`, `{"volume":101}`, `{"volume":-1}`} {
+		gin.SetMode(gin.TestMode)
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/spotify/playback-options", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+
+		PlaybackOptions(c)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTransferAndPlayActivatesBeforePlaying(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	active := false
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/me/player/devices":
+			calls = append(calls, "devices")
+			fmt.Fprintf(w, `{"devices":[{"id":"lib","name":"librespot","is_active":%t}]}`, active)
+			// The device registers on the second poll after activation.
+			if len(calls) > 2 {
+				active = true
+			}
+			return
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/me/player":
+			var body struct {
+				DeviceIDs []string `json:"device_ids"`
+				Play      bool     `json:"play"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Play || len(body.DeviceIDs) != 1 || body.DeviceIDs[0] != "lib" {
+				t.Errorf("activation body = %+v", body)
+			}
+			calls = append(calls, "activate")
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/me/player/play":
+			calls = append(calls, "play")
+		default:
+			calls = append(calls, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "t"}}}, "")
+	savedDelay := activationPollDelay
+	activationPollDelay = 0
+	defer func() { activationPollDelay = savedDelay }()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet,
+		"/spotify/devices/transfer-and-play?device_name=librespot&uri=spotify:album:abc", nil)
+
+	TransferAndPlay(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	activate, play := slices.Index(calls, "activate"), slices.Index(calls, "play")
+	if activate < 0 || play < 0 || activate > play {
+		t.Fatalf("calls = %v, want activate before play", calls)
+	}
+	// The first poll still reports the device inactive, so play must wait for
+	// the second.
+	polls := 0
+	for _, call := range calls[activate:play] {
+		if call == "devices" {
+			polls++
+		}
+	}
+	if polls != 2 {
+		t.Errorf("calls = %v, want 2 device polls between activate and play", calls)
+	}
+}
+
+func TestPlayGuardsPlaybackElsewhere(t *testing.T) {
+	tests := []struct {
+		name     string
+		playback string
+		query    string
+		want     int
+	}{
+		{name: "idle", playback: "", want: http.StatusOK},
+		{name: "playing on target", playback: `{"is_playing":true,"device":{"id":"lib","name":"librespot"}}`, want: http.StatusOK},
+		{name: "playing elsewhere", playback: `{"is_playing":true,"device":{"id":"phone","name":"iPhone"}}`, want: http.StatusConflict},
+		{name: "paused elsewhere", playback: `{"is_playing":false,"device":{"id":"phone","name":"iPhone"}}`, want: http.StatusOK},
+		{name: "forced", playback: `{"is_playing":true,"device":{"id":"phone","name":"iPhone"}}`, query: "&force=true", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			played := false
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/me/player/devices":
+					io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot"},{"id":"phone","name":"iPhone"}]}`)
+				case "/v1/me/player":
+					if tt.playback == "" {
+						w.WriteHeader(http.StatusNoContent)
+						return
+					}
+					io.WriteString(w, tt.playback)
+				case "/v1/me/player/play":
+					played = true
+					w.WriteHeader(http.StatusNoContent)
+				}
+			})
+
+			useEnvs(t, map[string]*Spotify{Home: {Name: Home, Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "t"}}}, "")
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/play?device_name=librespot"+tt.query, nil)
+
+			Play(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if played != (tt.want == http.StatusOK) {
+				t.Errorf("played = %v, want %v", played, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestSpotifyMiddlewareReadsEnvHeader(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"access_token":"fresh"}`)
+	})
+
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		want   string
+	}{
+		{name: "header only", header: string(Main), want: string(Main)},
+		{name: "query wins", query: "?env=" + string(Home), header: string(Main), want: string(Home)},
+		{name: "neither", want: string(Home)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useEnvs(t, map[string]*Spotify{
+				string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "m"}, tokensFilePath: t.TempDir() + "/main.txt"},
+				string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "h"}, tokensFilePath: t.TempDir() + "/home.txt"},
+			}, "")
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/queue"+tt.query, nil)
+			if tt.header != "" {
+				c.Request.Header.Set("X-Spotify-Env", tt.header)
+			}
+
+			SpotifyMiddleware()(c)
+
+			if c.IsAborted() {
+				t.Fatalf("request aborted: %s", rec.Body.String())
+			}
+			if currentEnv == nil || currentEnv.Name != tt.want {
+				t.Errorf("currentEnv = %v, want %s", currentEnv, tt.want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	var method, skippedOn string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player/devices":
+			io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot"}]}`)
+		case "/v1/me/player/next":
+			method = r.Method
+			skippedOn = r.URL.Query().Get("device_id")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "t"}}}, "")
+
+	tests := []struct {
+		name       string
+		query      string
+		want       int
+		wantDevice string
+	}{
+		{name: "named device", query: "?device_name=librespot", want: http.StatusOK, wantDevice: "lib"},
+		{name: "unknown device", query: "?device_name=toaster", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, skippedOn = "", ""
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/next"+tt.query, nil)
+
+			Next(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusOK && (method != http.MethodPost || skippedOn != tt.wantDevice) {
+				t.Errorf("skip sent as %s on %q, want POST on %q", method, skippedOn, tt.wantDevice)
+			}
+		})
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	var requested string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player/shuffle":
+			requested = r.URL.Query().Get("state")
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/me/player":
+			fmt.Fprintf(w, `{"shuffle_state":%s}`, requested)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+		body  string
+	}{
+		{name: "on", query: "?state=true", want: http.StatusOK, body: `{"shuffle":true}`},
+		{name: "off", query: "?state=false", want: http.StatusOK, body: `{"shuffle":false}`},
+		{name: "missing state", query: "", want: http.StatusBadRequest},
+		{name: "invalid state", query: "?state=maybe", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/shuffle"+tt.query, nil)
+
+			Shuffle(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	var requested string
+	status := http.StatusNoContent
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/me/player/repeat" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			return
+		}
+		requested = r.URL.Query().Get("state")
+		w.WriteHeader(status)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		name    string
+		query   string
+		spotify int
+		want    int
+	}{
+		{name: "off", query: "?state=off", spotify: http.StatusNoContent, want: http.StatusOK},
+		{name: "track", query: "?state=track", spotify: http.StatusNoContent, want: http.StatusOK},
+		{name: "invalid state", query: "?state=forever", want: http.StatusBadRequest},
+		{name: "spotify failure", query: "?state=context", spotify: http.StatusForbidden, want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested, status = "", tt.spotify
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/repeat"+tt.query, nil)
+
+			Repeat(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if wantState := c.Query("state"); tt.spotify != 0 && requested != wantState {
+				t.Errorf("sent state %q, want %q", requested, wantState)
+			}
+		})
+	}
+}
+
+func TestGetCurrentVolume(t *testing.T) {
+	var devices string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"devices":[%s]}`, devices)
+	})
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "t"}}
+
+	tests := []struct {
+		name    string
+		devices string
+		want    int
+		wantOk  bool
+	}{
+		{
+			name:    "active device",
+			devices: `{"id":"a","is_active":false,"volume_percent":90,"supports_volume":true},{"id":"b","is_active":true,"volume_percent":35,"supports_volume":true}`,
+			want:    35, wantOk: true,
+		},
+		{
+			name:    "no volume control",
+			devices: `{"id":"a","is_active":true,"volume_percent":100,"supports_volume":false}`,
+			want:    100, wantOk: false,
+		},
+		{name: "nothing active", devices: `{"id":"a","is_active":false,"volume_percent":70,"supports_volume":true}`},
+	}
+
+	for _, tt := range tests {
+		devices = tt.devices
+		got, ok := sp.getCurrentVolume(t.Context())
+		if ok != tt.wantOk || (ok && got != tt.want) {
+			t.Errorf("%s: getCurrentVolume() = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	var gotQuery url.Values
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		fmt.Fprint(w, `{"playlists":{"items":[{"name":"Rock & Roll","uri":"spotify:playlist:abc"}]}}`)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "?q=rock+%26+roll&type=playlist", want: http.StatusOK},
+		{query: "?q=+", want: http.StatusBadRequest},
+		{query: "?q=rock&type=artist", want: http.StatusBadRequest},
+		{query: "?q=rock&limit=0", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		gotQuery = nil
+
+		gin.SetMode(gin.TestMode)
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodGet, "/spotify/search"+tt.query, nil)
+
+		Search(c)
+
+		if rec.Code != tt.want {
+			t.Errorf("%q: status = %d, want %d (body %s)", tt.query, rec.Code, tt.want, rec.Body.String())
+		}
+		if tt.want != http.StatusOK {
+			if gotQuery != nil {
+				t.Errorf("%q: searched Spotify on a bad request", tt.query)
+			}
+			continue
+		}
+		if gotQuery.Get("q") != "rock & roll" || gotQuery.Get("type") != "playlist" || gotQuery.Get("limit") != "10" {
+			t.Errorf("%q: Spotify query = %v", tt.query, gotQuery)
+		}
+		if !strings.Contains(rec.Body.String(), `"uri":"spotify:playlist:abc"`) {
+			t.Errorf("%q: body = %s, want the playlist result", tt.query, rec.Body.String())
+		}
+	}
+}
+
+func TestRecentlyPlayedLimit(t *testing.T) {
+	var gotLimit string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		gotLimit = r.URL.Query().Get("limit")
+		fmt.Fprint(w, `{"items":[]}`)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		query     string
+		want      int
+		wantLimit string
+	}{
+		{query: "", want: http.StatusOK, wantLimit: "20"},
+		{query: "?limit=1", want: http.StatusOK, wantLimit: "1"},
+		{query: "?limit=50", want: http.StatusOK, wantLimit: "50"},
+		{query: "?limit=0", want: http.StatusBadRequest},
+		{query: "?limit=51", want: http.StatusBadRequest},
+		{query: "?limit=ten", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		gotLimit = ""
+
+		gin.SetMode(gin.TestMode)
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodGet, "/spotify/recent"+tt.query, nil)
+
+		RecentlyPlayed(c)
+
+		if rec.Code != tt.want {
+			t.Errorf("%q: status = %d, want %d (body %s)", tt.query, rec.Code, tt.want, rec.Body.String())
+		}
+		if gotLimit != tt.wantLimit {
+			t.Errorf("%q: Spotify limit = %q, want %q", tt.query, gotLimit, tt.wantLimit)
+		}
+	}
+}
+
+func TestSaveCurrent(t *testing.T) {
+	var playing, savedIDs string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player":
+			if playing == "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			fmt.Fprintf(w, `{"item":{"name":"Song","uri":%q}}`, playing)
+		case "/v1/me/tracks":
+			if r.Method != http.MethodPut {
+				t.Errorf("save sent as %s, want PUT", r.Method)
+			}
+			savedIDs = r.URL.Query().Get("ids")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		name    string
+		playing string
+		want    int
+		wantIDs string
+	}{
+		{name: "track", playing: "spotify:track:abc", want: http.StatusOK, wantIDs: "abc"},
+		{name: "nothing playing", want: http.StatusConflict},
+		{name: "episode", playing: "spotify:episode:xyz", want: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playing, savedIDs = tt.playing, ""
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/save", nil)
+
+			SaveCurrent(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if savedIDs != tt.wantIDs {
+				t.Errorf("saved ids = %q, want %q", savedIDs, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestPreviousReportsSpotifyStatus(t *testing.T) {
+	status := http.StatusNoContent
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/me/player/previous" || r.Method != http.MethodPost {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(status)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	for _, tt := range []struct {
+		spotify int
+		want    int
+	}{
+		{spotify: http.StatusNoContent, want: http.StatusOK},
+		{spotify: http.StatusForbidden, want: http.StatusBadGateway},
+	} {
+		status = tt.spotify
+
+		gin.SetMode(gin.TestMode)
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodGet, "/spotify/previous", nil)
+
+		Previous(c)
+
+		if rec.Code != tt.want {
+			t.Errorf("Spotify %d: status = %d, want %d", tt.spotify, rec.Code, tt.want)
+		}
+		var body struct {
+			SpotifyStatus int `json:"spotify_status"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		if body.SpotifyStatus != tt.spotify {
+			t.Errorf("spotify_status = %d, want %d", body.SpotifyStatus, tt.spotify)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	var sought string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player":
+			io.WriteString(w, `{"is_playing":true,"item":{"name":"Song","duration_ms":180000}}`)
+		case "/v1/me/player/seek":
+			sought = r.URL.Query().Get("position_ms")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+		sent  string
+	}{
+		{name: "within track", query: "position_ms=60000", want: http.StatusOK, sent: "60000"},
+		{name: "past the end", query: "position_ms=999999", want: http.StatusOK, sent: "180000"},
+		{name: "negative", query: "position_ms=-1", want: http.StatusBadRequest},
+		{name: "not a number", query: "position_ms=chorus", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sought = ""
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/seek?"+tt.query, nil)
+
+			Seek(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if sought != tt.sent {
+				t.Errorf("sent position_ms=%q, want %q", sought, tt.sent)
+			}
+		})
+	}
+}
+
+func TestNowPlaying(t *testing.T) {
+	playback := ""
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if playback == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		io.WriteString(w, playback)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	t.Setenv("DEVICE_ALIASES", "librespot=Living Room")
+
+	tests := []struct {
+		name     string
+		playback string
+		want     map[string]any
+	}{
+		{name: "idle", want: map[string]any{"playing": false}},
+		{
+			name: "playing",
+			playback: `{"is_playing":true,"progress_ms":1000,"device":{"name":"librespot"},
+				"item":{"name":"Song","uri":"spotify:track:1","duration_ms":3000,
+				"artists":[{"name":"A"},{"name":"B"}]}}`,
+			want: map[string]any{
+				"track": "Song", "artist": "A, B", "progress_ms": 1000.0, "duration_ms": 3000.0,
+				"is_playing": true, "device": "librespot", "display_name": "Living Room",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playback = tt.playback
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/now-playing", nil)
+
+			NowPlaying(c)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("unmarshal response: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("body = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddToQueue(t *testing.T) {
+	var queued []string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/me/player/queue" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			return
+		}
+		if r.Method == http.MethodPost {
+			queued = append(queued, r.URL.Query().Get("uri"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"queue": []Track{{Uri: "spotify:track:a"}, {Uri: "spotify:track:b"}}})
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, tokens: &Tokens{AccessToken: "t"}}}, Home)
+
+	tests := []struct {
+		name       string
+		uri        string
+		want       int
+		wantLength int
+	}{
+		{name: "track", uri: "spotify:track:b", want: http.StatusOK, wantLength: 2},
+		{name: "playlist", uri: "spotify:playlist:x", want: http.StatusBadRequest},
+		{name: "missing", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queued = nil
+
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/spotify/queue/add?uri="+url.QueryEscape(tt.uri), nil)
+
+			AddToQueue(c)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				if len(queued) != 0 {
+					t.Errorf("queued %v for a rejected URI", queued)
+				}
+				return
+			}
+
+			var body struct {
+				QueueLength int `json:"queue_length"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unmarshal response: %v", err)
+			}
+			if len(queued) != 1 || queued[0] != tt.uri {
+				t.Errorf("queued %v, want [%s]", queued, tt.uri)
+			}
+			if body.QueueLength != tt.wantLength {
+				t.Errorf("queue_length = %d, want %d", body.QueueLength, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestConcurrentPlayRequests(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/token":
+			io.WriteString(w, `{"access_token":"fresh"}`)
+		case "/v1/me/player/devices":
+			io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot"},{"id":"mac","name":"MacBook Air de Richard"}]}`)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	dir := t.TempDir()
+	useEnvs(t, map[string]*Spotify{
+		string(Home): {Name: string(Home), Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "h", RefreshToken: "r"}, tokensFilePath: dir + "/home.txt"},
+		string(Main): {Name: string(Main), Devices: []Device{{Name: "MacBook Air de Richard"}}, tokens: &Tokens{AccessToken: "m", RefreshToken: "r"}, tokensFilePath: dir + "/main.txt"},
+	}, "")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/spotify/play", SpotifyMiddleware(), Play)
+
+	devices := []string{"librespot", "MacBook+Air+de+Richard"}
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/spotify/play?device_name="+devices[i%2], nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, body = %s", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSpotifyMiddlewareSkipsRefreshForFreshToken(t *testing.T) {
+	var refreshes atomic.Int32
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		io.WriteString(w, `{"access_token":"new","expires_in":3600}`)
+	})
+
+	dir := t.TempDir()
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "m", ExpiresAt: time.Now().Add(time.Hour)}},
+		// Loaded from an old token file: no expiry known.
+		string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "h"}, tokensFilePath: dir + "/home.txt"},
+	}, "")
+
+	serve := func(env string) {
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/spotify/queue?env="+env, nil)
+		SpotifyMiddleware()(c)
+	}
+
+	serve(string(Main))
+	if n := refreshes.Load(); n != 0 {
+		t.Errorf("fresh token refreshed %d times, want 0", n)
+	}
+
+	serve(string(Home))
+	serve(string(Home))
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("token without expiry refreshed %d times over two requests, want 1", n)
+	}
+	if envs[string(Home)].getTokens().ExpiresAt.IsZero() {
+		t.Error("refresh did not record the new expiry")
+	}
+}
+
+func TestHTTPClientTimesOut(t *testing.T) {
+	if httpClient.Timeout == 0 {
+		t.Fatal("shared httpClient has no timeout")
+	}
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := newHTTPClient(50 * time.Millisecond)
+	start := time.Now()
+	_, err := client.Get(srv.URL)
+	if err == nil {
+		t.Fatal("request to a hung server succeeded, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s to time out", elapsed)
+	}
+}
+
+func TestMakeRequestRetriesRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"x":1}` {
+			t.Errorf("attempt %d sent body %q", calls.Load()+1, body)
+		}
+		if calls.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	savedWait := rateLimitMaxWait
+	rateLimitMaxWait = time.Millisecond
+	defer func() { rateLimitMaxWait = savedWait }()
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "t"}}
+	resp, err := sp.makeRequest(t.Context(), "PUT", PlayEndpoint, []byte(`{"x":1}`))
+	if err != nil {
+		t.Fatalf("makeRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("server saw %d calls, want 3", n)
+	}
+}
+
+func TestMakeRequestGivesUpAfterRetries(t *testing.T) {
+	var calls atomic.Int32
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	savedRetries, savedWait := rateLimitRetries, rateLimitMaxWait
+	rateLimitRetries, rateLimitMaxWait = 0, 0
+	defer func() { rateLimitRetries, rateLimitMaxWait = savedRetries, savedWait }()
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "t"}}
+	resp, err := sp.makeRequest(t.Context(), "GET", CurrentPlaybackEndpoint)
+	if err != nil {
+		t.Fatalf("makeRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 {
+		t.Errorf("status = %d after %d calls, want the 429 after 1", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestMakeRequestRefreshesTokenOn401(t *testing.T) {
+	var plays []string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/token" {
+			io.WriteString(w, `{"access_token":"new","expires_in":3600}`)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		plays = append(plays, r.Header.Get("Authorization")+" "+string(body))
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "old", RefreshToken: "r"}, tokensFilePath: t.TempDir() + "/home.txt"}
+	resp, err := sp.makeRequest(t.Context(), "PUT", PlayEndpoint, []byte(`{"uris":[]}`))
+	if err != nil {
+		t.Fatalf("makeRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	want := []string{`Bearer old {"uris":[]}`, `Bearer new {"uris":[]}`}
+	if !reflect.DeepEqual(plays, want) {
+		t.Errorf("requests = %q, want %q", plays, want)
+	}
+	if got := sp.getTokens().AccessToken; got != "new" {
+		t.Errorf("stored access token = %q, want new", got)
+	}
+}
+
+func TestMakeRequestRetries401OnlyOnce(t *testing.T) {
+	var calls atomic.Int32
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/token" {
+			io.WriteString(w, `{"access_token":"still-bad"}`)
+			return
+		}
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "old", RefreshToken: "r"}, tokensFilePath: t.TempDir() + "/home.txt"}
+	resp, err := sp.makeRequest(t.Context(), "GET", CurrentPlaybackEndpoint)
+	if err != nil {
+		t.Fatalf("makeRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized || calls.Load() != 2 {
+		t.Errorf("status = %d after %d calls, want 401 after 2", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestFetchDevicesGoesThroughMakeRequest(t *testing.T) {
+	var rateLimited atomic.Bool
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/token":
+			io.WriteString(w, `{"access_token":"new","expires_in":3600}`)
+		case r.Header.Get("Authorization") != "Bearer new":
+			w.WriteHeader(http.StatusUnauthorized)
+		case rateLimited.CompareAndSwap(false, true):
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot","is_active":true}]}`)
+		}
+	})
+
+	sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "old", RefreshToken: "r"}, tokensFilePath: t.TempDir() + "/home.txt"}
+
+	// An expired token and a 429 are both handled like any other request.
+	devices, err := sp.fetchDevices(t.Context())
+	if err != nil {
+		t.Fatalf("fetchDevices() error = %v", err)
+	}
+	if len(devices) != 1 || devices[0].ID != "lib" {
+		t.Errorf("devices = %+v, want librespot", devices)
+	}
+}
+
+func TestPlaylistRoute(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/me/player/devices":
+			io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot"}]}`)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/spotify/playlist", PlayPlaylist)
+
+	tests := []struct {
+		name    string
+		current string
+		query   string
+		want    int
+	}{
+		{name: "named device", query: "&device_name=librespot", want: http.StatusOK},
+		{name: "default device", current: Home, want: http.StatusOK},
+		{name: "no env selected yet", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useEnvs(t, map[string]*Spotify{Home: {Name: Home, Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "t"}}}, tt.current)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/spotify/playlist?uri=spotify:album:abc"+tt.query, nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPlayAndPauseUnknownDevice(t *testing.T) {
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home, Devices: []Device{{Name: "librespot"}}, tokens: &Tokens{AccessToken: "t"}}}, "")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/spotify/play", Play)
+	router.GET("/spotify/pause", Pause)
+
+	for _, path := range []string{"/spotify/play", "/spotify/pause"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?device_name=toaster", nil))
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+		if !strings.Contains(rec.Body.String(), "device 'toaster' not found in any environment") {
+			t.Errorf("%s: body = %s", path, rec.Body.String())
+		}
+	}
+}
+
+func TestPlayPlaylistWithoutTrackCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		playlist   string
+		wantErr    bool
+		wantOffset int
+	}{
+		{name: "empty playlist", status: http.StatusOK, playlist: `{"tracks":{"total":0}}`, wantErr: true},
+		{name: "fetch failed", status: http.StatusNotFound, playlist: `{}`, wantOffset: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			played := false
+			var offset struct {
+				Offset struct {
+					Position int `json:"position"`
+				} `json:"offset"`
+			}
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/playlists/0qPA1tBtiCLVHCUfREECnO":
+					w.WriteHeader(tt.status)
+					io.WriteString(w, tt.playlist)
+				case "/v1/me/player/play":
+					played = true
+					json.NewDecoder(r.Body).Decode(&offset)
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			})
+
+			sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "t"}}
+			resp, err := sp.playPlaylist(t.Context(), &Device{ID: "lib"}, RelaxPlaylistUri, 50)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("playPlaylist() error = nil, want an error for an empty playlist")
+				}
+				if played {
+					t.Error("started playback of an empty playlist")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("playPlaylist() error = %v", err)
+			}
+			resp.Body.Close()
+			if !played || offset.Offset.Position != tt.wantOffset {
+				t.Errorf("played = %v at position %d, want position %d", played, offset.Offset.Position, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestPlayPlaylistOffsetByContextKind(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantOffset bool
+	}{
+		{uri: "spotify:album:abc", wantOffset: true},
+		{uri: "spotify:artist:xyz", wantOffset: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			var body map[string]any
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/albums/abc/tracks":
+					io.WriteString(w, `{"total":3}`)
+				case "/v1/me/player/play":
+					json.NewDecoder(r.Body).Decode(&body)
+					w.WriteHeader(http.StatusNoContent)
+				case "/v1/me/player/volume":
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					t.Errorf("unexpected request to %s", r.URL.Path)
+				}
+			})
+
+			sp := &Spotify{Name: Home, tokens: &Tokens{AccessToken: "t"}}
+			resp, err := sp.playPlaylist(t.Context(), &Device{ID: "lib"}, tt.uri, 50)
+			if err != nil {
+				t.Fatalf("playPlaylist() error = %v", err)
+			}
+			resp.Body.Close()
+
+			offset, ok := body["offset"].(map[string]any)
+			if ok != tt.wantOffset {
+				t.Fatalf("offset = %v, want offset present: %v", body["offset"], tt.wantOffset)
+			}
+			if ok {
+				if pos := offset["position"].(float64); pos < 0 || pos >= 3 {
+					t.Errorf("position = %v, want within the album's 3 tracks", pos)
+				}
+			}
+		})
+	}
+}
+
+func TestDevicesEndpointFiltersByEnv(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer main" {
+			io.WriteString(w, `{"devices":[{"id":"mac","name":"MacBook Air de Richard","volume_percent":30}]}`)
+			return
+		}
+		io.WriteString(w, `{"devices":[{"id":"lib","name":"librespot"}]}`)
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "home", ExpiresAt: time.Now().Add(time.Hour)}},
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main", ExpiresAt: time.Now().Add(time.Hour)}},
+	}, "")
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/devices?env=main", nil)
+
+	Devices(c)
+
+	var body struct {
+		Environments []struct {
+			Environment string   `json:"environment"`
+			Devices     []Device `json:"devices"`
+		} `json:"environments"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(body.Environments) != 1 || body.Environments[0].Environment != string(Main) {
+		t.Fatalf("environments = %+v, want only main", body.Environments)
+	}
+	if devices := body.Environments[0].Devices; len(devices) != 1 || devices[0].VolumenPercent != 30 {
+		t.Errorf("devices = %+v, want the MacBook at 30%%", devices)
+	}
+}
@@ -0,0 +1,31 @@
+package spotify
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger is the package's leveled logger. LOG_LEVEL sets the minimum level;
+// DEBUG=true always logs everything.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	Level: logLevel(os.Getenv("LOG_LEVEL"), debugMode),
+}))
+
+// logLevel parses LOG_LEVEL (debug, info, warn or error), defaulting to info.
+// debug forces the debug level.
+func logLevel(raw string, debug bool) slog.Level {
+	if debug {
+		return slog.LevelDebug
+	}
+
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,81 @@
+package spotify
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// How long a login may take between /login and Spotify's callback.
+const oauthStateTTL = 5 * time.Minute
+
+// oauthLogin is a login started by /login, waiting for its callback.
+type oauthLogin struct {
+	env     string
+	expires time.Time
+	// verifier is the PKCE code verifier, empty for the client secret flow.
+	verifier string
+}
+
+// oauthStates holds the pending logins by their state parameter, so the
+// callback only accepts codes from a login this server started.
+var (
+	oauthStatesMu sync.Mutex
+	oauthStates   = make(map[string]oauthLogin)
+)
+
+// newOAuthState records a login for env, with its PKCE verifier if any, and
+// returns its state parameter.
+func newOAuthState(env, verifier string) string {
+	state := randomToken(16)
+	now := time.Now()
+
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	for s, login := range oauthStates {
+		if now.After(login.expires) {
+			delete(oauthStates, s)
+		}
+	}
+	oauthStates[state] = oauthLogin{env: env, expires: now.Add(oauthStateTTL), verifier: verifier}
+	return state
+}
+
+// takeOAuthState consumes a state parameter, returning the login it belongs
+// to. Unknown, reused and expired states report ok=false.
+func takeOAuthState(state string) (oauthLogin, bool) {
+	oauthStatesMu.Lock()
+	defer oauthStatesMu.Unlock()
+
+	login, ok := oauthStates[state]
+	if !ok {
+		return oauthLogin{}, false
+	}
+	delete(oauthStates, state)
+	if time.Now().After(login.expires) {
+		return oauthLogin{}, false
+	}
+	return login, true
+}
+
+// newCodeVerifier returns a PKCE code verifier (RFC 7636 allows 43-128
+// characters; 64 random bytes encode to 86).
+func newCodeVerifier() string {
+	return randomToken(64)
+}
+
+// codeChallenge derives the S256 code challenge sent with the authorize URL.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes, URL-safe base64 encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
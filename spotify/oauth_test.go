@@ -0,0 +1,175 @@
+package spotify
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func callback(query string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/callback"+query, nil)
+
+	Callback(c)
+	return rec
+}
+
+func TestCallbackRejectsBadState(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	})
+
+	useEnvs(t, map[string]*Spotify{Home: {Name: Home}}, "")
+
+	expired := newOAuthState(Home, "")
+	oauthStatesMu.Lock()
+	oauthStates[expired] = oauthLogin{env: Home, expires: time.Now().Add(-time.Second)}
+	oauthStatesMu.Unlock()
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "missing state", query: "?code=abc"},
+		{name: "wrong state", query: "?code=abc&state=forged"},
+		{name: "expired state", query: "?code=abc&state=" + expired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := callback(tt.query); rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestCallbackAcceptsStateOnce(t *testing.T) {
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/token" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		io.WriteString(w, `{"access_token":"a","refresh_token":"r","expires_in":3600}`)
+	})
+
+	home := &Spotify{Name: Home, tokensFilePath: t.TempDir() + "/home.txt"}
+	// The state, not the current env, decides which env logs in.
+	useEnvs(t, map[string]*Spotify{Home: home, Main: {Name: Main}}, Main)
+
+	state := newOAuthState(Home, "")
+
+	if rec := callback("?code=abc&state=" + state); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if tokens := home.getTokens(); tokens == nil || tokens.AccessToken != "a" {
+		t.Errorf("home tokens = %+v, want the new ones", tokens)
+	}
+
+	if rec := callback("?code=abc&state=" + state); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused state status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPKCELogin(t *testing.T) {
+	var form url.Values
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		io.WriteString(w, `{"access_token":"a","refresh_token":"r"}`)
+	})
+
+	home := &Spotify{Name: Home, ClientId: "id", ClientSecret: "secret", UsePKCE: true, tokensFilePath: t.TempDir() + "/home.txt"}
+	useEnvs(t, map[string]*Spotify{Home: home}, "")
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/login?env=home", nil)
+	Login(c)
+
+	authorize, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorize URL %s lacks an S256 code challenge", authorize)
+	}
+
+	if rec := callback("?code=abc&state=" + query.Get("state")); rec.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if form.Has("client_secret") {
+		t.Error("PKCE token exchange sent the client secret")
+	}
+	if got := codeChallenge(form.Get("code_verifier")); got != query.Get("code_challenge") {
+		t.Errorf("challenge of the sent verifier = %q, want %q", got, query.Get("code_challenge"))
+	}
+}
+
+func TestConcurrentRefreshesSpendRefreshTokenOnce(t *testing.T) {
+	// Like a PKCE client: every refresh token works once and is rotated.
+	var (
+		mu      sync.Mutex
+		valid   = "r0"
+		grants  int
+		revoked int
+	)
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.PostForm.Get("refresh_token") != valid {
+			revoked++
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		grants++
+		valid = fmt.Sprintf("r%d", grants)
+		fmt.Fprintf(w, `{"access_token":"a%d","refresh_token":%q,"expires_in":3600}`, grants, valid)
+	})
+
+	sp := &Spotify{Name: Home, UsePKCE: true, tokens: &Tokens{AccessToken: "old", RefreshToken: "r0"}, tokensFilePath: t.TempDir() + "/home.txt"}
+
+	// The middleware's refresh and a 401 retry racing for the same env.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				err = sp.refreshTokenIfNeeded()
+			} else {
+				_, err = sp.refreshToken()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("refresh error = %v", err)
+		}
+	}
+	if revoked != 0 {
+		t.Errorf("%d refreshes spent a revoked refresh token", revoked)
+	}
+	if got := sp.getTokens().RefreshToken; got != valid {
+		t.Errorf("stored refresh token = %q, want the latest %q", got, valid)
+	}
+}
@@ -0,0 +1,196 @@
+package spotify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+// envFile is the dotenv file re-read by Reload.
+var envFile = ".env"
+
+// dotenvValues are the settings last applied from envFile, so a reload can
+// drop the keys the file no longer sets.
+var (
+	dotenvMu        sync.Mutex
+	dotenvValues, _ = godotenv.Read(envFile)
+)
+
+// Reload re-reads the .env file and rebuilds the environments from it. The new
+// settings are validated first; on any error the running config is kept.
+// Tokens carry over, so no env needs to log in again. Keys removed from the
+// file are unset. LOG_LEVEL, DEBUG and SPOTIFY_MAX_CONCURRENCY are only read
+// at startup.
+func Reload(c *gin.Context) {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+
+	values, err := godotenv.Read(envFile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("reading %s: %v", envFile, err),
+		})
+		return
+	}
+
+	// Only drop a removed key while it still holds the value the file gave
+	// it; anything else was set outside the file.
+	var removed []string
+	for key, value := range dotenvValues {
+		if _, ok := values[key]; !ok && os.Getenv(key) == value {
+			removed = append(removed, key)
+		}
+	}
+
+	lookup := envLookup(values)
+	getenv := func(key string) string {
+		if slices.Contains(removed, key) {
+			return ""
+		}
+		return lookup(key)
+	}
+
+	if err := validateConfig(getenv); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("config rejected, keeping the current one: %v", err),
+		})
+		return
+	}
+
+	// Hold the old envs' refresh locks until the swap, so a refresh in
+	// flight can't rotate a PKCE token after it was copied.
+	old := allEnvs()
+	for _, sp := range old {
+		sp.refreshMu.Lock()
+		defer sp.refreshMu.Unlock()
+	}
+
+	fresh := make(map[string]*Spotify, len(EnvironmentName))
+	for environment := range EnvironmentName {
+		sp := buildEnv(environment, getenv)
+		if prev, ok := old[string(environment)]; ok {
+			sp.tokens = prev.getTokens()
+		} else if tokens, err := readTokensFromFile(sp.tokensFilePath); err == nil {
+			sp.tokens = tokens
+		}
+		fresh[string(environment)] = sp
+	}
+
+	// Settings read at use time (aliases, allow-list, ...) pick up the new
+	// values from the process environment.
+	replaceEnvs(fresh, func() {
+		for _, key := range removed {
+			os.Unsetenv(key)
+		}
+		for key, value := range values {
+			os.Setenv(key, value)
+		}
+	})
+	dotenvValues = values
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Configuration reloaded",
+	})
+}
+
+// Readiness lists what keeps the Spotify side from working: an unreadable
+// .env file and configured envs that have never logged in. Nothing is sent
+// to Spotify.
+func Readiness() []string {
+	var missing []string
+
+	values, err := godotenv.Read(envFile)
+	if err != nil {
+		missing = append(missing, fmt.Sprintf("%s could not be read: %v", envFile, err))
+	}
+	getenv := envLookup(values)
+
+	// Read the two settings directly: buildEnv would log a warning about bad
+	// scopes on every poll.
+	for environment := range EnvironmentName {
+		name := string(environment)
+		if getenv(strings.ToUpper(name)+"_SP_CLIENT_ID") == "" {
+			continue // not configured on this host
+		}
+		if _, err := os.Stat(tokensFilePath(environment)); err != nil {
+			missing = append(missing, fmt.Sprintf("no tokens for %s, log in at /spotify/login?env=%s", name, name))
+		}
+	}
+
+	slices.Sort(missing)
+	return missing
+}
+
+// envLookup reads settings from dotenv values, falling back to the process
+// environment.
+func envLookup(values map[string]string) func(string) string {
+	return func(key string) string {
+		if v, ok := values[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	}
+}
+
+// validateConfig checks the settings a reload would apply and reports every
+// problem found.
+func validateConfig(getenv func(string) string) error {
+	var errs []error
+
+	for _, prefix := range []string{"MAIN_", "HOME_"} {
+		if _, err := parseScopes(getenv(prefix + "SP_SCOPES")); err != nil {
+			errs = append(errs, fmt.Errorf("%sSP_SCOPES: %w", prefix, err))
+		}
+		if v := getenv(prefix + "SP_CALLBACK_URI"); v != "" {
+			if u, err := url.Parse(v); err != nil || !u.IsAbs() {
+				errs = append(errs, fmt.Errorf("%sSP_CALLBACK_URI: %q is not an absolute URL", prefix, v))
+			}
+		}
+	}
+
+	for pair := range strings.SplitSeq(getenv("DEVICE_ALIASES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		raw, alias, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(raw) == "" || strings.TrimSpace(alias) == "" {
+			errs = append(errs, fmt.Errorf("DEVICE_ALIASES: %q is not a raw=Display pair", pair))
+		}
+	}
+
+	if v := getenv("SCHEDULE_MAX_HORIZON"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("SCHEDULE_MAX_HORIZON: %q is not a positive duration", v))
+		}
+	}
+
+	if v := getenv("ALARM_MAX_SNOOZES"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("ALARM_MAX_SNOOZES: %q is not a non-negative integer", v))
+		}
+	}
+
+	if v := getenv("ALARM_VOLUME"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 || n > 100 {
+			errs = append(errs, fmt.Errorf("ALARM_VOLUME: %q is not between 0 and 100", v))
+		}
+	}
+
+	if v := getenv("RELAX_PLAYLIST_URI"); v != "" {
+		if _, _, err := parseContextId(v); err != nil {
+			errs = append(errs, fmt.Errorf("RELAX_PLAYLIST_URI: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
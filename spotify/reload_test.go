@@ -0,0 +1,180 @@
+package spotify
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func reload(t *testing.T, dotenv string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte(dotenv), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := envFile
+	envFile = path
+	t.Cleanup(func() { envFile = saved })
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+
+	Reload(c)
+	return rec
+}
+
+func TestReloadRejectsBadConfig(t *testing.T) {
+	t.Setenv("HOME_SP_CLIENT_ID", "old-id")
+	t.Setenv("HOME_SP_SCOPES", "")
+
+	old := &Spotify{Name: string(Home), ClientId: "old-id"}
+	useEnvs(t, map[string]*Spotify{string(Home): old}, string(Home))
+
+	rec := reload(t, "HOME_SP_CLIENT_ID=new-id\nHOME_SP_SCOPES=user-libary-modify\n")
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if envs[string(Home)] != old || currentEnv != old {
+		t.Error("a rejected reload replaced the running env")
+	}
+	if got := os.Getenv("HOME_SP_CLIENT_ID"); got != "old-id" {
+		t.Errorf("HOME_SP_CLIENT_ID = %q, a rejected reload must not touch the environment", got)
+	}
+}
+
+func TestReloadSwapsConfigAndKeepsTokens(t *testing.T) {
+	t.Setenv("HOME_SP_CLIENT_ID", "old-id")
+
+	tokens := &Tokens{AccessToken: "a", RefreshToken: "r"}
+	old := &Spotify{Name: string(Home), ClientId: "old-id", tokens: tokens}
+	useEnvs(t, map[string]*Spotify{string(Home): old}, string(Home))
+
+	rec := reload(t, "HOME_SP_CLIENT_ID=new-id\n")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	home := envs[string(Home)]
+	if home == old || home.ClientId != "new-id" {
+		t.Fatalf("home env = %+v, want a rebuilt env with the new client id", home)
+	}
+	if home.tokens != tokens {
+		t.Error("reload dropped the env's tokens")
+	}
+	if currentEnv != home {
+		t.Error("currentEnv still points at the old env")
+	}
+}
+
+func TestReloadWaitsForRefreshInFlight(t *testing.T) {
+	t.Setenv("HOME_SP_CLIENT_ID", "id")
+
+	old := &Spotify{Name: string(Home), ClientId: "id", tokens: &Tokens{AccessToken: "a", RefreshToken: "r1"}}
+	useEnvs(t, map[string]*Spotify{string(Home): old}, string(Home))
+
+	// A refresh holds the lock and rotates the token while the reload runs.
+	old.refreshMu.Lock()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- reload(t, "HOME_SP_CLIENT_ID=id\n") }()
+
+	time.Sleep(50 * time.Millisecond)
+	rotated := &Tokens{AccessToken: "b", RefreshToken: "r2"}
+	old.setTokens(rotated)
+	old.refreshMu.Unlock()
+
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got := getEnv(string(Home)).getTokens(); got != rotated {
+		t.Errorf("reloaded env tokens = %+v, want the ones the refresh rotated in", got)
+	}
+}
+
+func TestReloadUnsetsRemovedKeys(t *testing.T) {
+	t.Setenv("HOME_SP_CLIENT_ID", "")
+	t.Setenv("PLAYLIST_ALLOWLIST", "")
+	t.Setenv("DEVICE_ALIASES", "raw=Outside")
+
+	useEnvs(t, nil, "")
+
+	savedValues := dotenvValues
+	dotenvValues = nil
+	defer func() { dotenvValues = savedValues }()
+
+	rec := reload(t, "HOME_SP_CLIENT_ID=id\nPLAYLIST_ALLOWLIST=spotify:playlist:abc\n")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got := os.Getenv("PLAYLIST_ALLOWLIST"); got != "spotify:playlist:abc" {
+		t.Fatalf("PLAYLIST_ALLOWLIST = %q after the first reload", got)
+	}
+
+	// The allow-list is gone from the file; DEVICE_ALIASES never was in it.
+	rec = reload(t, "HOME_SP_CLIENT_ID=id\n")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got, ok := os.LookupEnv("PLAYLIST_ALLOWLIST"); ok {
+		t.Errorf("PLAYLIST_ALLOWLIST = %q, want it unset once removed from .env", got)
+	}
+	if got := os.Getenv("HOME_SP_CLIENT_ID"); got != "id" {
+		t.Errorf("HOME_SP_CLIENT_ID = %q, want the value still in .env", got)
+	}
+	if got := os.Getenv("DEVICE_ALIASES"); got != "raw=Outside" {
+		t.Errorf("DEVICE_ALIASES = %q, a key the file never set must be left alone", got)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("MAIN_SP_CLIENT_ID", "")
+	t.Setenv("HOME_SP_CLIENT_ID", "")
+
+	saved := envFile
+	envFile = ".env"
+	defer func() { envFile = saved }()
+
+	if got := Readiness(); len(got) != 1 {
+		t.Fatalf("Readiness() without .env = %q, want one missing piece", got)
+	}
+
+	if err := os.WriteFile(".env", []byte("HOME_SP_CLIENT_ID=id\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := Readiness(); len(got) != 1 {
+		t.Fatalf("Readiness() without home tokens = %q, want one missing piece", got)
+	}
+
+	// Main has no client id, so it is not expected to have tokens.
+	if err := writeTokensToFile(&Tokens{AccessToken: "a", RefreshToken: "r"}, ".tokens/.tokens-home.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := Readiness(); len(got) != 0 {
+		t.Errorf("Readiness() = %q, want ready", got)
+	}
+
+	// Probes poll it; a bad setting must not log on every call.
+	var logs bytes.Buffer
+	savedLogger := logger
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	defer func() { logger = savedLogger }()
+
+	if err := os.WriteFile(".env", []byte("HOME_SP_CLIENT_ID=id\nHOME_SP_SCOPES=bogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	Readiness()
+	if logs.Len() != 0 {
+		t.Errorf("Readiness() logged %q", logs.String())
+	}
+}
@@ -0,0 +1,525 @@
+package spotify
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	alarmTokenAttempts = 3
+
+	// An alarm starts quietly and fades up to ALARM_VOLUME.
+	alarmStartVolume   = 10
+	defaultAlarmVolume = 60
+
+	defaultSnoozeMinutes = 9
+	defaultMaxSnoozes    = 3
+)
+
+var (
+	errNoAlarm     = errors.New("no alarm has fired to snooze")
+	errSnoozeLimit = errors.New("snooze limit reached")
+)
+
+// Delay between token refresh attempts when an alarm fires.
+var alarmTokenRetryDelay = 20 * time.Second
+
+// How long an alarm takes to fade from alarmStartVolume to ALARM_VOLUME.
+var alarmFadeDuration = 90 * time.Second
+
+// scheduledTask is what a schedule fires. The target env and device are only
+// names; they are resolved when the task fires, so a device that is offline at
+// scheduling time can still be targeted.
+type scheduledTask struct {
+	Action     string `json:"action"`
+	Env        string `json:"env,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	// Uri is the context an alarm plays; empty means relaxPlaylistUri().
+	Uri string `json:"uri,omitempty"`
+	// Snoozes counts how many times this alarm has already been snoozed.
+	Snoozes int `json:"snoozes,omitempty"`
+	// Repeat is "daily" for a task that re-arms after each run, limited to
+	// Days when set; empty means it runs once.
+	Repeat string         `json:"repeat,omitempty"`
+	Days   []time.Weekday `json:"days,omitempty"`
+}
+
+// lastAlarm is the most recently fired alarm, the one /snooze re-arms.
+var (
+	lastAlarmMu sync.Mutex
+	lastAlarm   *scheduledTask
+)
+
+// scheduleFn arms a task; tests swap it to observe scheduling without waiting.
+var scheduleFn = schedule
+
+// clock tells the time recurring tasks are re-armed from; tests swap it.
+var clock = time.Now
+
+// schedulesFile keeps the pending tasks so they survive a restart.
+var schedulesFile = ".schedules.json"
+
+// persistedTask is a pending task as stored in schedulesFile.
+type persistedTask struct {
+	ID string `json:"id"`
+	At int64  `json:"at"` // epoch millis
+	scheduledTask
+
+	// timerID is the schedule id of the armed timer; a recurring task gets a
+	// new timer each time it is re-armed but keeps its ID.
+	timerID string
+}
+
+// pending holds the armed tasks by ID, mirrored to schedulesFile.
+var (
+	pendingMu sync.Mutex
+	pending   = make(map[string]persistedTask)
+)
+
+// armTask schedules task at epochMillis and keeps it in schedulesFile until
+// it fires or is cancelled. It returns the task ID, "" when nothing was armed.
+func armTask(epochMillis int64, task scheduledTask) string {
+	return armTaskAs("", epochMillis, task)
+}
+
+// armTaskAs is armTask keeping a known ID, used when restoring and re-arming
+// tasks. An empty id takes the timer's id.
+func armTaskAs(id string, epochMillis int64, task scheduledTask) string {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	var timerID string
+	timerID = scheduleFn(epochMillis, func() {
+		pendingMu.Lock()
+		if entry, ok := pending[id]; !ok || entry.timerID != timerID {
+			pendingMu.Unlock()
+			return
+		}
+		delete(pending, id)
+		savePendingLocked()
+		pendingMu.Unlock()
+
+		// Re-arm before running, so a slow or failing run can't break the
+		// series.
+		if next, ok := task.nextRun(time.UnixMilli(epochMillis), clock()); ok {
+			armTaskAs(id, next.UnixMilli(), task)
+		}
+		task.run()
+	})
+	if timerID == "" {
+		return ""
+	}
+	if id == "" {
+		id = timerID
+	}
+
+	pending[id] = persistedTask{ID: id, At: epochMillis, scheduledTask: task, timerID: timerID}
+	savePendingLocked()
+	return id
+}
+
+// cancelTask stops a pending task, including every later run of a recurring
+// one, and drops it from schedulesFile.
+func cancelTask(id string) bool {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	entry, ok := pending[id]
+	if !ok {
+		return false
+	}
+	cancelSchedule(entry.timerID)
+	delete(pending, id)
+	savePendingLocked()
+	return true
+}
+
+// savePendingLocked writes pending to schedulesFile; pendingMu must be held.
+func savePendingLocked() {
+	tasks := make([]persistedTask, 0, len(pending))
+	for _, task := range pending {
+		tasks = append(tasks, task)
+	}
+	if err := saveSchedules(schedulesFile, tasks); err != nil {
+		logger.Error("Failed to save schedules", "file", schedulesFile, "err", err)
+	}
+}
+
+// saveSchedules writes tasks to fileName, earliest first.
+func saveSchedules(fileName string, tasks []persistedTask) error {
+	slices.SortFunc(tasks, func(a, b persistedTask) int {
+		return cmp.Compare(a.At, b.At)
+	})
+
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0600)
+}
+
+// loadSchedules reads the tasks saved by saveSchedules. A missing file means
+// there is nothing to restore.
+func loadSchedules(fileName string) ([]persistedTask, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []persistedTask
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// RestoreSchedules re-arms the tasks saved before the last shutdown under
+// their old IDs. One-shot tasks whose time passed while the server was down
+// are discarded; recurring ones move on to their next run.
+func RestoreSchedules() {
+	tasks, err := loadSchedules(schedulesFile)
+	if err != nil {
+		logger.Error("Failed to load schedules", "file", schedulesFile, "err", err)
+		return
+	}
+
+	now := clock()
+	for _, task := range tasks {
+		if err := task.validate(); err != nil {
+			logger.Warn("Discarding invalid scheduled task", "err", err)
+			continue
+		}
+		if at := time.UnixMilli(task.At); !at.After(now) {
+			next, ok := task.nextRun(at, now)
+			if !ok {
+				logger.Info("Discarding expired task", "action", task.Action, "at", at)
+				continue
+			}
+			task.At = next.UnixMilli()
+		}
+		id := armTaskAs(task.ID, task.At, task.scheduledTask)
+		logger.Info("Restored task", "action", task.Action, "at", time.UnixMilli(task.At), "id", id)
+	}
+
+	// Rewrite the file so discarded tasks don't linger.
+	pendingMu.Lock()
+	savePendingLocked()
+	pendingMu.Unlock()
+}
+
+// validate checks the parts of a task that can be known before it fires.
+func (t scheduledTask) validate() error {
+	switch t.Action {
+	case "alarm", "sleep":
+	default:
+		return fmt.Errorf("unknown action %q: must be alarm or sleep", t.Action)
+	}
+	if t.Env != "" {
+		if _, ok := EnvironmentName[Environment(t.Env)]; !ok {
+			return fmt.Errorf("unknown env %q", t.Env)
+		}
+	}
+	if t.Uri != "" {
+		if _, _, err := parseContextId(t.Uri); err != nil {
+			return err
+		}
+	}
+	switch t.Repeat {
+	case "", "daily":
+	default:
+		return fmt.Errorf("unknown repeat %q: must be daily", t.Repeat)
+	}
+	if len(t.Days) > 0 && t.Repeat == "" {
+		return errors.New("days requires repeat=daily")
+	}
+	return nil
+}
+
+// runsOn reports whether a recurring task runs on day.
+func (t scheduledTask) runsOn(day time.Weekday) bool {
+	return len(t.Days) == 0 || slices.Contains(t.Days, day)
+}
+
+// nextRun is the first time after both last and now with last's wall-clock
+// time on one of the task's days. One-shot tasks have no next run.
+func (t scheduledTask) nextRun(last, now time.Time) (time.Time, bool) {
+	if t.Repeat == "" {
+		return time.Time{}, false
+	}
+
+	last = last.Local()
+	from := now.Local()
+	if last.After(from) {
+		from = last
+	}
+	for i := 0; i <= 7; i++ {
+		next := time.Date(from.Year(), from.Month(), from.Day()+i,
+			last.Hour(), last.Minute(), last.Second(), 0, time.Local)
+		if next.After(from) && t.runsOn(next.Weekday()) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseDays reads a comma-separated list of day abbreviations (mon,tue,...).
+func parseDays(raw string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for name := range strings.SplitSeq(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		day, ok := weekdays[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q: use sun, mon, tue, wed, thu, fri or sat", name)
+		}
+		if !slices.Contains(days, day) {
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+func (t scheduledTask) run() {
+	if err := t.fire(context.Background()); err != nil {
+		logger.Error("Scheduled task failed", "action", t.Action, "err", err)
+	}
+}
+
+func (t scheduledTask) fire(ctx context.Context) error {
+	switch t.Action {
+	case "alarm":
+		return t.fireAlarm(ctx)
+	case "sleep":
+		return t.fireSleep(ctx)
+	}
+	return nil
+}
+
+func (t scheduledTask) fireSleep(ctx context.Context) error {
+	sp := t.targetEnv(ctx)
+	if sp == nil {
+		return fmt.Errorf("no environment for env=%q device_name=%q", t.Env, t.DeviceName)
+	}
+
+	if err := refreshTokenWithRetry(ctx, sp); err != nil {
+		return fmt.Errorf("token for %s is not usable: %w", sp.Name, err)
+	}
+
+	// Without a reachable target device, pause whatever the env is playing on.
+	deviceID := ""
+	if t.DeviceName != "" {
+		device, err := sp.deviceByName(ctx, t.DeviceName)
+		if err != nil {
+			return fmt.Errorf("could not resolve device: %w", err)
+		}
+		if device != nil {
+			deviceID = device.ID
+		} else {
+			logger.Warn("sleep: device not reachable, pausing the active device", "device_name", t.DeviceName)
+		}
+	}
+
+	resp, err := sp.pausePlayback(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to pause: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := playbackError(resp); err != nil {
+		return fmt.Errorf("failed to pause: %w", err)
+	}
+	return nil
+}
+
+func (t scheduledTask) fireAlarm(ctx context.Context) error {
+	sp := t.targetEnv(ctx)
+	if sp == nil {
+		return fmt.Errorf("no environment for env=%q device_name=%q", t.Env, t.DeviceName)
+	}
+
+	lastAlarmMu.Lock()
+	lastAlarm = &t
+	lastAlarmMu.Unlock()
+
+	// The token may have expired or been revoked overnight; find out now
+	// rather than failing on the first playback call.
+	if err := refreshTokenWithRetry(ctx, sp); err != nil {
+		return fmt.Errorf("token for %s is not usable: %w", sp.Name, err)
+	}
+
+	device, err := t.targetDevice(ctx, sp)
+	if err != nil {
+		logger.Warn("alarm: could not resolve device", "err", err)
+	}
+
+	uri := t.Uri
+	if uri == "" {
+		uri = relaxPlaylistUri()
+	}
+
+	// Devices without volume control can't fade; they play as they are.
+	target := alarmVolume()
+	fade := device != nil && device.SupportsVolume && target > alarmStartVolume
+	volume := target
+	if fade {
+		volume = alarmStartVolume
+	}
+
+	resp, err := sp.playPlaylist(ctx, device, uri, volume)
+	if err != nil {
+		return fmt.Errorf("failed to play: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := playbackError(resp); err != nil {
+		return fmt.Errorf("failed to play: %w", err)
+	}
+
+	if fade {
+		if err := sp.fadeVolume(ctx, device.ID, alarmStartVolume, target, alarmFadeDuration); err != nil {
+			logger.Warn("alarm: fade failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// snoozeAlarm pauses the last fired alarm and re-arms it after delay,
+// returning the re-armed task and its schedule id. It fails when no alarm has
+// fired or the alarm was snoozed maxSnoozes times already.
+func snoozeAlarm(ctx context.Context, delay time.Duration, maxSnoozes int) (scheduledTask, string, error) {
+	// Claim the alarm under the lock, but pause outside it: the Spotify calls
+	// must not hold up a firing alarm.
+	lastAlarmMu.Lock()
+	if lastAlarm == nil {
+		lastAlarmMu.Unlock()
+		return scheduledTask{}, "", errNoAlarm
+	}
+	if lastAlarm.Snoozes >= maxSnoozes {
+		lastAlarmMu.Unlock()
+		return scheduledTask{}, "", fmt.Errorf("%w (%d)", errSnoozeLimit, maxSnoozes)
+	}
+	alarm := *lastAlarm
+	lastAlarm = nil
+	lastAlarmMu.Unlock()
+
+	if sp := alarm.targetEnv(ctx); sp != nil {
+		if err := sp.pauseCurrentPlayback(ctx); err != nil {
+			logger.Warn("snooze: failed to pause", "err", err)
+		}
+	}
+
+	// The snoozed copy runs once; a recurring alarm keeps its own series.
+	snoozed := alarm
+	snoozed.Snoozes++
+	snoozed.Repeat, snoozed.Days = "", nil
+
+	id := armTask(time.Now().Add(delay).UnixMilli(), snoozed)
+	return snoozed, id, nil
+}
+
+// maxSnoozes reads ALARM_MAX_SNOOZES, defaulting to defaultMaxSnoozes.
+func maxSnoozes() int {
+	if v := os.Getenv("ALARM_MAX_SNOOZES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+		logger.Warn("Invalid ALARM_MAX_SNOOZES, using the default", "value", v, "default", defaultMaxSnoozes)
+	}
+	return defaultMaxSnoozes
+}
+
+// relaxPlaylistUri reads RELAX_PLAYLIST_URI, the context an alarm plays by
+// default, falling back to RelaxPlaylistUri.
+func relaxPlaylistUri() string {
+	if v := os.Getenv("RELAX_PLAYLIST_URI"); v != "" {
+		if _, _, err := parseContextId(v); err == nil {
+			return v
+		}
+		logger.Warn("Invalid RELAX_PLAYLIST_URI, using the default", "value", v, "default", RelaxPlaylistUri)
+	}
+	return RelaxPlaylistUri
+}
+
+// alarmVolume reads ALARM_VOLUME (0-100), defaulting to defaultAlarmVolume.
+func alarmVolume() int {
+	if v := os.Getenv("ALARM_VOLUME"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 100 {
+			return n
+		}
+		logger.Warn("Invalid ALARM_VOLUME, using the default", "value", v, "default", defaultAlarmVolume)
+	}
+	return defaultAlarmVolume
+}
+
+// refreshTokenWithRetry refreshes sp's token, retrying a few times so a brief
+// network blip at fire time doesn't cancel the alarm.
+func refreshTokenWithRetry(ctx context.Context, sp *Spotify) error {
+	var err error
+	for attempt := 1; attempt <= alarmTokenAttempts; attempt++ {
+		if _, err = sp.refreshToken(); err == nil {
+			return nil
+		}
+		logger.Warn("alarm: token refresh failed", "env", sp.Name, "attempt", attempt, "of", alarmTokenAttempts, "err", err)
+		if attempt < alarmTokenAttempts {
+			if err := sleep(ctx, alarmTokenRetryDelay); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// targetEnv picks the task's env by name, then by the env owning its device,
+// and falls back to whatever env is current for tasks without a target.
+func (t scheduledTask) targetEnv(ctx context.Context) *Spotify {
+	// A task restored after a restart can fire before any request has
+	// created the envs.
+	if len(allEnvs()) == 0 {
+		initEnvs()
+	}
+	if t.Env != "" {
+		return getEnv(t.Env)
+	}
+	if t.DeviceName != "" {
+		return getEnvFromDeviceName(ctx, t.DeviceName)
+	}
+	return getCurrentEnv()
+}
+
+// targetDevice resolves the task's device in sp. When it is not reachable the
+// active device is used instead, so the alarm still rings somewhere.
+func (t scheduledTask) targetDevice(ctx context.Context, sp *Spotify) (*Device, error) {
+	if t.DeviceName != "" {
+		device, err := sp.deviceByName(ctx, t.DeviceName)
+		if err != nil {
+			return nil, err
+		}
+		if device != nil {
+			return device, nil
+		}
+		logger.Warn("alarm: device not reachable, using the active device", "device_name", t.DeviceName)
+	}
+	return sp.activeDevice(ctx)
+}
@@ -0,0 +1,631 @@
+package spotify
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestScheduledAlarmTargetsEnvAndDeviceAtFireTime(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		playToken  string
+		playDevice string
+	)
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/api/token":
+			io.WriteString(w, `{"access_token":"main"}`)
+		case "/v1/me/player/devices":
+			// The speaker only shows up now, at fire time.
+			io.WriteString(w, `{"devices":[
+				{"id":"phone","name":"iPhone","is_active":true},
+				{"id":"mac","name":"MacBook Air de Richard","supports_volume":true}
+			]}`)
+		case "/v1/playlists/0qPA1tBtiCLVHCUfREECnO":
+			io.WriteString(w, `{"tracks":{"total":5}}`)
+		case "/v1/me/player/play":
+			playToken = r.Header.Get("Authorization")
+			playDevice = r.URL.Query().Get("device_id")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main"}, tokensFilePath: t.TempDir() + "/main.txt"},
+		string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "home"}},
+	}, string(Home))
+
+	savedFade := alarmFadeDuration
+	alarmFadeDuration = 0
+	defer func() { alarmFadeDuration = savedFade }()
+
+	task := scheduledTask{Action: "alarm", Env: string(Main), DeviceName: "MacBook Air de Richard"}
+	if err := task.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+	if err := task.fire(t.Context()); err != nil {
+		t.Fatalf("fire() = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if playToken != "Bearer main" {
+		t.Errorf("played with %q, want the main env's token", playToken)
+	}
+	if playDevice != "mac" {
+		t.Errorf("played on device_id %q, want mac", playDevice)
+	}
+}
+
+func TestScheduledAlarmFadesInVolume(t *testing.T) {
+	tests := []struct {
+		name           string
+		supportsVolume bool
+		want           []string
+	}{
+		{
+			name:           "fades",
+			supportsVolume: true,
+			want:           []string{"10", "15", "20", "25", "30", "35", "40", "45", "50", "55", "60"},
+		},
+		{name: "no volume control", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				volumes []string
+			)
+			fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				switch r.URL.Path {
+				case "/api/token":
+					io.WriteString(w, `{"access_token":"main"}`)
+				case "/v1/me/player/devices":
+					fmt.Fprintf(w, `{"devices":[{"id":"mac","name":"MacBook Air de Richard","is_active":true,"supports_volume":%t}]}`, tt.supportsVolume)
+				case "/v1/playlists/0qPA1tBtiCLVHCUfREECnO":
+					io.WriteString(w, `{"tracks":{"total":5}}`)
+				case "/v1/me/player/volume":
+					volumes = append(volumes, r.URL.Query().Get("volume_percent"))
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			})
+
+			useEnvs(t, map[string]*Spotify{
+				string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main"}, tokensFilePath: t.TempDir() + "/main.txt"},
+			}, string(Main))
+
+			savedFade := alarmFadeDuration
+			alarmFadeDuration = 0
+			defer func() { alarmFadeDuration = savedFade }()
+
+			task := scheduledTask{Action: "alarm", Env: string(Main), DeviceName: "MacBook Air de Richard"}
+			if err := task.fire(t.Context()); err != nil {
+				t.Fatalf("fire() = %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(volumes, tt.want) {
+				t.Errorf("volume requests = %v, want %v", volumes, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduledSleepPausesTargetEnvAtFireTime(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		pauseToken  string
+		pauseDevice string
+	)
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/api/token":
+			io.WriteString(w, `{"access_token":"main"}`)
+		case "/v1/me/player/devices":
+			io.WriteString(w, `{"devices":[{"id":"mac","name":"MacBook Air de Richard","is_active":true}]}`)
+		case "/v1/me/player/pause":
+			pauseToken = r.Header.Get("Authorization")
+			pauseDevice = r.URL.Query().Get("device_id")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main"}, tokensFilePath: t.TempDir() + "/main.txt"},
+		string(Home): {Name: string(Home), tokens: &Tokens{AccessToken: "home"}},
+	}, string(Home))
+
+	task := scheduledTask{Action: "sleep", Env: string(Main), DeviceName: "MacBook Air de Richard"}
+	if err := task.fire(t.Context()); err != nil {
+		t.Fatalf("fire() = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if pauseToken != "Bearer main" {
+		t.Errorf("paused with %q, want the main env's token", pauseToken)
+	}
+	if pauseDevice != "mac" {
+		t.Errorf("paused device_id %q, want mac", pauseDevice)
+	}
+}
+
+func TestScheduledTaskValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    scheduledTask
+		wantErr bool
+	}{
+		{name: "alarm", task: scheduledTask{Action: "alarm"}},
+		{name: "sleep with env", task: scheduledTask{Action: "sleep", Env: string(Home)}},
+		{name: "unknown action", task: scheduledTask{Action: "dance"}, wantErr: true},
+		{name: "unknown env", task: scheduledTask{Action: "alarm", Env: "office"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.task.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduledAlarmSurfacesTokenFailure(t *testing.T) {
+	savedDelay := alarmTokenRetryDelay
+	alarmTokenRetryDelay = 0
+	defer func() { alarmTokenRetryDelay = savedDelay }()
+
+	var refreshes int
+	played := false
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/token":
+			refreshes++
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+		case "/v1/me/player/play":
+			played = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "revoked", RefreshToken: "revoked"}},
+	}, "")
+
+	err := scheduledTask{Action: "alarm", Env: string(Main)}.fire(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("fire() error = %v, want the refresh failure", err)
+	}
+	if refreshes != alarmTokenAttempts {
+		t.Errorf("token refreshes = %d, want %d", refreshes, alarmTokenAttempts)
+	}
+	if played {
+		t.Error("alarm tried to play with an unusable token")
+	}
+}
+
+func TestSnoozePausesAndReschedulesAlarm(t *testing.T) {
+	paused, locked := false, false
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/me/player/pause" {
+			paused = true
+			// An alarm firing now must not wait on the pause.
+			if lastAlarmMu.TryLock() {
+				lastAlarmMu.Unlock()
+			} else {
+				locked = true
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	useEnvs(t, map[string]*Spotify{
+		string(Main): {Name: string(Main), tokens: &Tokens{AccessToken: "main"}},
+	}, "")
+
+	useSchedulesFile(t)
+
+	var scheduledAt int64
+	var scheduled func()
+	savedSchedule := scheduleFn
+	scheduleFn = func(epochMillis int64, action func()) string {
+		scheduledAt, scheduled = epochMillis, action
+		return "snoozed"
+	}
+	defer func() { scheduleFn = savedSchedule }()
+
+	lastAlarmMu.Lock()
+	lastAlarm = &scheduledTask{Action: "alarm", Env: string(Main)}
+	lastAlarmMu.Unlock()
+	defer func() { lastAlarm = nil }()
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/snooze?minutes=5", nil)
+
+	Snooze(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if !paused {
+		t.Error("snooze did not pause playback")
+	}
+	if locked {
+		t.Error("snooze held lastAlarmMu while pausing")
+	}
+	if scheduled == nil {
+		t.Fatal("snooze did not re-arm the alarm")
+	}
+	if delay := time.Until(time.UnixMilli(scheduledAt)); delay < 4*time.Minute || delay > 5*time.Minute {
+		t.Errorf("re-armed %s from now, want ~5m", delay)
+	}
+
+	// Nothing left to snooze until the re-armed alarm fires again.
+	rec = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/spotify/snooze", nil)
+	Snooze(c)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("second snooze status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestSnoozeLimit(t *testing.T) {
+	savedSchedule := scheduleFn
+	scheduleFn = func(int64, func()) string { return "" }
+	defer func() { scheduleFn = savedSchedule }()
+
+	useEnvs(t, nil, "")
+
+	lastAlarmMu.Lock()
+	lastAlarm = &scheduledTask{Action: "alarm", Env: string(Main), Snoozes: 2}
+	lastAlarmMu.Unlock()
+	defer func() { lastAlarm = nil }()
+
+	if _, _, err := snoozeAlarm(t.Context(), time.Minute, 2); !errors.Is(err, errSnoozeLimit) {
+		t.Fatalf("snoozeAlarm() error = %v, want errSnoozeLimit", err)
+	}
+}
+
+// useSchedulesFile points schedulesFile at a temporary file and starts the
+// test with no pending tasks.
+func useSchedulesFile(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), ".schedules.json")
+	saved := schedulesFile
+	schedulesFile = path
+	t.Cleanup(func() {
+		schedulesFile = saved
+		pendingMu.Lock()
+		clear(pending)
+		pendingMu.Unlock()
+	})
+	return path
+}
+
+func TestSchedulesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".schedules.json")
+	want := []persistedTask{
+		{At: 1000, scheduledTask: scheduledTask{Action: "alarm", Env: string(Home), Uri: "spotify:playlist:abc"}},
+		{At: 2000, scheduledTask: scheduledTask{Action: "sleep", DeviceName: "librespot"}},
+	}
+
+	if err := saveSchedules(path, slices.Clone(want)); err != nil {
+		t.Fatalf("saveSchedules() error = %v", err)
+	}
+	got, err := loadSchedules(path)
+	if err != nil {
+		t.Fatalf("loadSchedules() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadSchedules() = %+v, want %+v", got, want)
+	}
+
+	got, err = loadSchedules(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || got != nil {
+		t.Errorf("loadSchedules(missing) = %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestRestoreSchedulesDropsExpiredTasks(t *testing.T) {
+	path := useSchedulesFile(t)
+
+	var armed []int64
+	savedSchedule := scheduleFn
+	scheduleFn = func(epochMillis int64, action func()) string {
+		armed = append(armed, epochMillis)
+		return fmt.Sprintf("id-%d", len(armed))
+	}
+	defer func() { scheduleFn = savedSchedule }()
+
+	future := time.Now().Add(time.Hour).UnixMilli()
+	err := saveSchedules(path, []persistedTask{
+		{At: time.Now().Add(-time.Hour).UnixMilli(), scheduledTask: scheduledTask{Action: "alarm"}},
+		{At: future, scheduledTask: scheduledTask{Action: "sleep"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RestoreSchedules()
+
+	if !reflect.DeepEqual(armed, []int64{future}) {
+		t.Errorf("armed %v, want only the future task", armed)
+	}
+	saved, err := loadSchedules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].At != future {
+		t.Errorf("schedules file = %+v, want only the future task", saved)
+	}
+}
+
+func TestRestoredTaskCreatesEnvs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("HOME_SP_CLIENT_ID", "id")
+	if err := os.WriteFile(".env", []byte("HOME_SP_CLIENT_ID=id\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTokensToFile(&Tokens{AccessToken: "stale", RefreshToken: "r"}, ".tokens/.tokens-home.txt"); err != nil {
+		t.Fatal(err)
+	}
+	path := useSchedulesFile(t)
+
+	var pauseToken string
+	fakeSpotify(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/token":
+			io.WriteString(w, `{"access_token":"home"}`)
+		case "/v1/me/player/pause":
+			pauseToken = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	var action func()
+	savedSchedule := scheduleFn
+	scheduleFn = func(_ int64, fn func()) string {
+		action = fn
+		return "timer"
+	}
+	defer func() { scheduleFn = savedSchedule }()
+
+	err := saveSchedules(path, []persistedTask{
+		{ID: "sleep", At: time.Now().Add(time.Hour).UnixMilli(), scheduledTask: scheduledTask{Action: "sleep", Env: string(Home)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Just restarted: no request has created the envs yet.
+	useEnvs(t, nil, "")
+
+	RestoreSchedules()
+	if action == nil {
+		t.Fatal("RestoreSchedules() armed nothing")
+	}
+	action()
+
+	if pauseToken != "Bearer home" {
+		t.Errorf("paused with %q, want the home env's refreshed token", pauseToken)
+	}
+}
+
+func TestSchedulePinsCurrentEnv(t *testing.T) {
+	path := useSchedulesFile(t)
+
+	savedSchedule := scheduleFn
+	scheduleFn = func(int64, func()) string { return "timer" }
+	defer func() { scheduleFn = savedSchedule }()
+
+	useEnvs(t, map[string]*Spotify{string(Main): {Name: string(Main)}}, string(Main))
+
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet,
+		fmt.Sprintf("/spotify/schedule?action=sleep&time_millis=%d", time.Now().Add(time.Hour).UnixMilli()), nil)
+
+	Schedule(c)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	tasks, err := loadSchedules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Env != string(Main) {
+		t.Errorf("schedules file = %+v, want one task pinned to main", tasks)
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	monday := time.Date(2026, time.October, 12, 22, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name   string
+		task   scheduledTask
+		now    time.Time
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			name: "one-shot",
+			task: scheduledTask{Action: "alarm"},
+			now:  monday,
+		},
+		{
+			name:   "daily",
+			task:   scheduledTask{Action: "alarm", Repeat: "daily"},
+			now:    monday.Add(time.Second),
+			want:   monday.AddDate(0, 0, 1),
+			wantOK: true,
+		},
+		{
+			name:   "skips to the next listed day",
+			task:   scheduledTask{Action: "alarm", Repeat: "daily", Days: []time.Weekday{time.Monday, time.Wednesday}},
+			now:    monday.Add(time.Second),
+			want:   monday.AddDate(0, 0, 2),
+			wantOK: true,
+		},
+		{
+			name:   "wraps into next week",
+			task:   scheduledTask{Action: "alarm", Repeat: "daily", Days: []time.Weekday{time.Monday}},
+			now:    monday.Add(time.Second),
+			want:   monday.AddDate(0, 0, 7),
+			wantOK: true,
+		},
+		{
+			name:   "catches up after downtime",
+			task:   scheduledTask{Action: "alarm", Repeat: "daily"},
+			now:    monday.AddDate(0, 0, 3).Add(time.Hour),
+			want:   monday.AddDate(0, 0, 4),
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.task.nextRun(monday, tt.now)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("nextRun() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	got, err := parseDays("mon, Tue,mon,fri")
+	if err != nil {
+		t.Fatalf("parseDays() error = %v", err)
+	}
+	want := []time.Weekday{time.Monday, time.Tuesday, time.Friday}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDays() = %v, want %v", got, want)
+	}
+
+	if _, err := parseDays("mon,funday"); err == nil {
+		t.Error("parseDays(unknown day) error = nil")
+	}
+}
+
+func TestRecurringTaskRearmsAfterFiring(t *testing.T) {
+	useSchedulesFile(t)
+
+	type arm struct {
+		at     int64
+		action func()
+	}
+	var arms []arm
+	savedSchedule := scheduleFn
+	scheduleFn = func(epochMillis int64, action func()) string {
+		arms = append(arms, arm{epochMillis, action})
+		return fmt.Sprintf("timer-%d", len(arms))
+	}
+	defer func() { scheduleFn = savedSchedule }()
+
+	monday := time.Date(2026, time.October, 12, 22, 0, 0, 0, time.Local)
+	savedClock := clock
+	clock = func() time.Time { return monday }
+	defer func() { clock = savedClock }()
+
+	// The task's env is missing: the run itself fails fast and only the
+	// re-arm matters.
+	useEnvs(t, map[string]*Spotify{string(Main): {Name: string(Main)}}, "")
+
+	task := scheduledTask{Action: "sleep", Env: string(Home), Repeat: "daily", Days: []time.Weekday{time.Monday, time.Friday}}
+	id := armTask(monday.UnixMilli(), task)
+
+	arms[0].action()
+
+	if len(arms) != 2 {
+		t.Fatalf("armed %d times, want a re-arm after firing", len(arms))
+	}
+	if want := monday.AddDate(0, 0, 4).UnixMilli(); arms[1].at != want {
+		t.Errorf("re-armed for %s, want %s", time.UnixMilli(arms[1].at), time.UnixMilli(want))
+	}
+	pendingMu.Lock()
+	entry, ok := pending[id]
+	pendingMu.Unlock()
+	if !ok || entry.At != arms[1].at {
+		t.Fatalf("pending[%s] = %+v, %v, want the next run under the same id", id, entry, ok)
+	}
+
+	// Cancelling by the original id stops the series.
+	if !cancelTask(id) {
+		t.Fatal("cancelTask() = false for a recurring task")
+	}
+	arms[1].action()
+	if len(arms) != 2 {
+		t.Error("a cancelled recurring task re-armed itself")
+	}
+}
+
+func TestAlarmSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		volume     string
+		wantUri    string
+		wantVolume int
+	}{
+		{name: "defaults when unset", wantUri: RelaxPlaylistUri, wantVolume: defaultAlarmVolume},
+		{name: "configured", uri: "spotify:album:morning", volume: "35", wantUri: "spotify:album:morning", wantVolume: 35},
+		{name: "invalid values fall back", uri: "not-a-uri", volume: "150", wantUri: RelaxPlaylistUri, wantVolume: defaultAlarmVolume},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RELAX_PLAYLIST_URI", tt.uri)
+			t.Setenv("ALARM_VOLUME", tt.volume)
+
+			if got := relaxPlaylistUri(); got != tt.wantUri {
+				t.Errorf("relaxPlaylistUri() = %q, want %q", got, tt.wantUri)
+			}
+			if got := alarmVolume(); got != tt.wantVolume {
+				t.Errorf("alarmVolume() = %d, want %d", got, tt.wantVolume)
+			}
+		})
+	}
+}
@@ -2,43 +2,105 @@ package spotify
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"golang.org/x/sync/semaphore"
 )
 
 var (
+	// envsMu guards envs and currentEnv; use the accessors in utils.go.
+	envsMu     sync.RWMutex
 	currentEnv *Spotify
 	envs       = make(map[string]*Spotify)
 	debugMode  = os.Getenv("DEBUG") == "true"
+	httpClient = newHTTPClient(requestTimeout)
+
+	// Delay before retrying a playback read that failed with a 5xx.
+	playbackRetryDelay = 500 * time.Millisecond
+
+	outboundOnce sync.Once
+	outboundSem  *semaphore.Weighted
+
+	// How long a fading device handoff takes.
+	handoffDuration = 3 * time.Second
+
+	// Delay between device-list polls while waiting for an activated device.
+	activationPollDelay = 500 * time.Millisecond
+
+	// How often a 429 is retried, and the longest Retry-After honored.
+	rateLimitRetries = 3
+	rateLimitMaxWait = 30 * time.Second
 )
 
 const (
 	CurrentPlaybackEndpoint = "https://api.spotify.com/v1/me/player"
 	UserQueueEndpoint       = "https://api.spotify.com/v1/me/player/queue"
 	PlayEndpoint            = "https://api.spotify.com/v1/me/player/play"
+	SavedTracksEndpoint     = "https://api.spotify.com/v1/me/tracks"
+	RecentlyPlayedEndpoint  = "https://api.spotify.com/v1/me/player/recently-played"
 	RelaxPlaylistUri        = "spotify:playlist:0qPA1tBtiCLVHCUfREECnO"
+
+	defaultQueueLimit = 20
+
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+
+	// Spotify serves at most 50 recently played tracks per request.
+	defaultRecentLimit = 20
+	maxRecentLimit     = 50
+
+	defaultScheduleHorizon = 7 * 24 * time.Hour
+
+	defaultMaxConcurrency = 4
+
+	// Number of volume changes in a fade.
+	fadeSteps = 10
+
+	// How many times the device list is polled after activating a device.
+	activationAttempts = 10
+
+	// Access tokens this close to expiry are refreshed before use.
+	tokenRefreshMargin = 60 * time.Second
+
+	// Upper bound for any single Spotify API call, so a hung connection
+	// can't block a handler forever.
+	requestTimeout = 15 * time.Second
 )
 
 type Spotify struct {
-	Name           string
-	CallbackUri    string
-	ClientId       string
-	ClientSecret   string
+	Name         string
+	CallbackUri  string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// UsePKCE logs in with PKCE instead of the client secret, for a public
+	// client whose secret isn't kept on this host.
+	UsePKCE        bool
 	Devices        []Device
 	tokensFilePath string
-	tokens         *Tokens
+
+	// mu guards tokens and the Devices entries updated from Spotify. Tokens
+	// are replaced, never modified in place.
+	mu     sync.RWMutex
+	tokens *Tokens
+
+	// refreshMu serializes token refreshes: a PKCE refresh token is single
+	// use, so a second refresh in flight would spend a revoked one.
+	refreshMu sync.Mutex
 }
 
 type Device struct {
@@ -47,11 +109,19 @@ type Device struct {
 	IsActive       bool   `json:"is_active"`
 	VolumenPercent int    `json:"volume_percent"`
 	SupportsVolume bool   `json:"supports_volume"`
+	DisplayName    string `json:"display_name"`
 }
 
 type Tokens struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+}
+
+// needsRefresh reports whether the access token expires within
+// tokenRefreshMargin of now. A token with unknown expiry always needs one.
+func (t *Tokens) needsRefresh(now time.Time) bool {
+	return t.ExpiresAt.IsZero() || now.Add(tokenRefreshMargin).After(t.ExpiresAt)
 }
 
 type Playback struct {
@@ -80,10 +150,25 @@ type Playlist struct {
 }
 
 type Track struct {
-	Type       string `json:"type"`
-	Name       string `json:"name"`
-	Uri        string `json:"uri"`
-	DurationMs int    `json:"duration_ms"`
+	Type       string   `json:"type"`
+	Name       string   `json:"name"`
+	Uri        string   `json:"uri"`
+	DurationMs int      `json:"duration_ms"`
+	Artists    []Artist `json:"artists"`
+	Album      struct {
+		Images []Image `json:"images"`
+	} `json:"album"`
+}
+
+type Artist struct {
+	Name string `json:"name"`
+	Uri  string `json:"uri"`
+}
+
+type Image struct {
+	URL    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
 }
 
 type UserQueue struct {
@@ -91,6 +176,14 @@ type UserQueue struct {
 	Queue            []Track `json:"queue"`
 }
 
+// PlayHistory is a page of the user's play history, newest first.
+type PlayHistory struct {
+	Items []struct {
+		Track    Track     `json:"track"`
+		PlayedAt time.Time `json:"played_at"`
+	} `json:"items"`
+}
+
 // Home is the Spotify instance used in home
 // Main is the main instance of Spotify that i use
 type Environment string
@@ -106,18 +199,39 @@ var EnvironmentName = map[Environment]string{
 }
 
 func new(environment Environment) *Spotify {
+	envsMu.Lock()
+	defer envsMu.Unlock()
+
 	// If exists return it, this avoid duplicates instances
 	if _, exists := envs[string(environment)]; exists {
-		log.Println("Returning existent Spotify instance")
+		logger.Debug("Returning existent Spotify instance", "env", environment)
 		return envs[string(environment)]
 	}
-	log.Println("Creating new Spotify instance")
+	logger.Info("Creating new Spotify instance", "env", environment)
 
 	if err := godotenv.Load(); err != nil {
-		log.Fatalln(".env not found")
+		logger.Error(".env not found", "err", err)
+		os.Exit(1)
+	}
+
+	sp := buildEnv(environment, os.Getenv)
+	if sp == nil {
 		return nil
 	}
 
+	if tokens, err := readTokensFromFile(sp.tokensFilePath); err == nil {
+		sp.tokens = tokens
+	} else {
+		logger.Warn("Tokens not found", "env", sp.Name)
+	}
+
+	envs[string(environment)] = sp
+	return sp
+}
+
+// buildEnv assembles the settings of an environment from getenv, without
+// tokens. Returns nil for an unknown environment.
+func buildEnv(environment Environment, getenv func(string) string) *Spotify {
 	var sp Spotify
 	envPrefix := ""
 	defaultVolume := 50
@@ -125,30 +239,36 @@ func new(environment Environment) *Spotify {
 	switch environment {
 	case Main:
 		envPrefix = "MAIN_"
-		sp.Devices = []Device{{"", "iPhone", false, defaultVolume, false}, {"", "MacBook Air de Richard", false, defaultVolume, true}, {"", "MD3HKDVJW4", false, defaultVolume, true}}
+		sp.Devices = []Device{{"", "iPhone", false, defaultVolume, false, ""}, {"", "MacBook Air de Richard", false, defaultVolume, true, ""}, {"", "MD3HKDVJW4", false, defaultVolume, true, ""}}
 	case Home:
 		envPrefix = "HOME_"
-		sp.Devices = []Device{{"", "librespot", false, defaultVolume, true}}
+		sp.Devices = []Device{{"", "librespot", false, defaultVolume, true, ""}}
 	default:
 		return nil
 	}
 
 	sp.Name = string(environment)
-	sp.ClientId = os.Getenv(envPrefix + "SP_CLIENT_ID")
-	sp.ClientSecret = os.Getenv(envPrefix + "SP_CLIENT_SECRET")
-	sp.CallbackUri = os.Getenv(envPrefix + "SP_CALLBACK_URI")
-	sp.tokensFilePath = fmt.Sprintf(".tokens/.tokens-%s.txt", string(environment))
+	sp.ClientId = getenv(envPrefix + "SP_CLIENT_ID")
+	sp.ClientSecret = getenv(envPrefix + "SP_CLIENT_SECRET")
+	sp.CallbackUri = getenv(envPrefix + "SP_CALLBACK_URI")
+	sp.UsePKCE = getenv(envPrefix+"SP_PKCE") == "true"
 
-	if tokens, err := readTokensFromFile(sp.tokensFilePath); err == nil {
-		sp.tokens = tokens
+	if scopes, err := parseScopes(getenv(envPrefix + "SP_SCOPES")); err == nil {
+		sp.Scopes = scopes
 	} else {
-		log.Printf("tokens not found for %s", sp.Name)
+		logger.Warn("Invalid scopes, using the default scopes", "var", envPrefix+"SP_SCOPES", "err", err)
+		sp.Scopes = defaultScopes
 	}
+	sp.tokensFilePath = tokensFilePath(environment)
 
-	envs[string(environment)] = &sp
 	return &sp
 }
 
+// tokensFilePath is where an environment's tokens are stored.
+func tokensFilePath(environment Environment) string {
+	return fmt.Sprintf(".tokens/.tokens-%s.txt", string(environment))
+}
+
 func (sp *Spotify) String() string {
 
 	names := make([]string, 0, len(sp.Devices))
@@ -160,38 +280,46 @@ func (sp *Spotify) String() string {
 	return fmt.Sprintf("Name: %s, Devices: %v", sp.Name, strings.Join(names, ", "))
 }
 
-func (sp *Spotify) updateDevicesData() error {
-	if sp.tokens == nil {
-		return fmt.Errorf("no tokens loaded for env %q", sp.Name)
-	}
+func (sp *Spotify) getTokens() *Tokens {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.tokens
+}
 
-	urlStr := "https://api.spotify.com/v1/me/player/devices"
+func (sp *Spotify) setTokens(tokens *Tokens) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.tokens = tokens
+}
 
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// hasDevice reports whether deviceName is one of the env's configured devices.
+func (sp *Spotify) hasDevice(deviceName string) bool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	for _, device := range sp.Devices {
+		if device.Name == deviceName {
+			return true
+		}
 	}
+	return false
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.tokens.AccessToken))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func (sp *Spotify) deviceCount() int {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return len(sp.Devices)
+}
 
+func (sp *Spotify) updateDevicesData(ctx context.Context) error {
+	devices, err := sp.fetchDevices(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to execute request: %w", err)
-	}
-
-	defer resp.Body.Close()
-
-	var devicesResponse struct {
-		Devices []Device `json:"devices"`
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&devicesResponse); err != nil {
-		return fmt.Errorf("Failed in request when retrieving device: %w", err)
-	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
 
-	for _, device := range devicesResponse.Devices {
+	for _, device := range devices {
 		for i := range sp.Devices {
 			if sp.Devices[i].Name == device.Name {
 				sp.Devices[i].ID = device.ID
@@ -205,22 +333,17 @@ func (sp *Spotify) updateDevicesData() error {
 
 // fetchDevices returns every device Spotify currently reports as reachable for
 // this environment, regardless of whether one is actively playing.
-func (sp *Spotify) fetchDevices() ([]Device, error) {
-	if sp.tokens == nil {
-		return nil, fmt.Errorf("no tokens loaded for env %q", sp.Name)
-	}
-
-	req, err := http.NewRequest("GET", "https://api.spotify.com/v1/me/player/devices", nil)
+func (sp *Spotify) fetchDevices(ctx context.Context) ([]Device, error) {
+	resp, err := sp.makeRequest(ctx, "GET", "https://api.spotify.com/v1/me/player/devices")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.tokens.AccessToken))
+	defer resp.Body.Close()
 
-	resp, err := (&http.Client{}).Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		printResponseBody(resp)
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
-	defer resp.Body.Close()
 
 	var devicesResponse struct {
 		Devices []Device `json:"devices"`
@@ -235,12 +358,12 @@ func (sp *Spotify) fetchDevices() ([]Device, error) {
 // deviceByName looks up a reachable device by name from the live Spotify device
 // list. Returns (nil, nil) when the name isn't currently reachable, so callers
 // can distinguish "not reachable" from "Spotify unreachable" (error).
-func (sp *Spotify) deviceByName(deviceName string) (*Device, error) {
+func (sp *Spotify) deviceByName(ctx context.Context, deviceName string) (*Device, error) {
 	if deviceName == "" {
 		return nil, fmt.Errorf("device name is empty")
 	}
 
-	devices, err := sp.fetchDevices()
+	devices, err := sp.fetchDevices(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -256,8 +379,8 @@ func (sp *Spotify) deviceByName(deviceName string) (*Device, error) {
 
 // activeDevice returns the currently active reachable device, falling back to
 // the first reachable one. Returns (nil, nil) when nothing is reachable.
-func (sp *Spotify) activeDevice() (*Device, error) {
-	devices, err := sp.fetchDevices()
+func (sp *Spotify) activeDevice(ctx context.Context) (*Device, error) {
+	devices, err := sp.fetchDevices(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -275,38 +398,125 @@ func (sp *Spotify) activeDevice() (*Device, error) {
 	return nil, nil
 }
 
-func (sp *Spotify) makeRequest(method string, urlStr string, body ...[]byte) (*http.Response, error) {
-	var bodyReader io.Reader
+// newHTTPClient builds the client shared by all Spotify calls. Connections are
+// pooled across requests; the idle ones are dropped after a while so a stale
+// socket isn't reused long after Spotify closed it.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        20,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// outboundLimiter caps how many Spotify API calls are in flight at once so a
+// burst of automations can't trip Spotify's rate limits. The limit comes from
+// SPOTIFY_MAX_CONCURRENCY and is read on first use, after .env is loaded;
+// a reload doesn't change it.
+func outboundLimiter() *semaphore.Weighted {
+	outboundOnce.Do(func() {
+		limit := defaultMaxConcurrency
+		if v := os.Getenv("SPOTIFY_MAX_CONCURRENCY"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				limit = n
+			} else {
+				logger.Warn("Invalid SPOTIFY_MAX_CONCURRENCY, using the default", "value", v, "default", defaultMaxConcurrency)
+			}
+		}
+		outboundSem = semaphore.NewWeighted(int64(limit))
+	})
+	return outboundSem
+}
+
+func (sp *Spotify) makeRequest(ctx context.Context, method string, urlStr string, body ...[]byte) (*http.Response, error) {
+	tokens := sp.getTokens()
+	if tokens == nil {
+		return nil, fmt.Errorf("no tokens loaded for env %q", sp.Name)
+	}
+
+	var payload []byte
 	if len(body) > 0 {
-		bodyReader = bytes.NewBuffer(body[0])
+		payload = body[0]
+	}
+
+	logger.Debug("Making request", "method", method, "url", urlStr)
+
+	accessToken := tokens.AccessToken
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		resp, err := sp.doRequest(ctx, method, urlStr, payload, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		// The token expired mid-session: refresh it and retry once.
+		if resp.StatusCode == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			newToken, err := sp.refreshToken()
+			if err != nil {
+				logger.Warn("Got 401 and could not refresh the token", "env", sp.Name, "err", err)
+			} else {
+				resp.Body.Close()
+				logger.Info("Got 401, retrying with a refreshed token", "env", sp.Name)
+				accessToken = newToken
+				continue
+			}
+		}
+
+		// Spotify rate limits bursts of commands; wait as told and retry.
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < rateLimitRetries {
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			logger.Warn("Rate limited by Spotify, retrying", "wait", wait, "attempt", attempt+1, "of", rateLimitRetries)
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		logger.Debug("Request status", "url", urlStr, "status", resp.Status)
+
+		if resp.StatusCode == http.StatusBadRequest {
+			printResponseBody(resp)
+		}
+
+		return resp, nil
 	}
+}
 
-	log.Println(fmt.Sprintf("Making request to %s", urlStr))
+// doRequest sends one authorized request to Spotify; a nil body sends none.
+// The body is taken as bytes so a retry can send it again.
+func (sp *Spotify) doRequest(ctx context.Context, method, urlStr string, body []byte, accessToken string) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
 
-	req, err := http.NewRequest(method, urlStr, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	if len(body) > 0 {
+	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.tokens.AccessToken))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 	req.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	limiter := outboundLimiter()
+	if err := limiter.Acquire(req.Context(), 1); err != nil {
+		return nil, fmt.Errorf("waiting for request slot: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	limiter.Release(1)
 	if err != nil {
 		return nil, fmt.Errorf("failed in request: %w", err)
 	}
-
-	log.Println(fmt.Sprintf("Request status: %s", resp.Status))
-
-	if resp.StatusCode == http.StatusBadRequest {
-		fmt.Println("Bad request:")
-		printResponseBody(resp)
-	}
-
 	return resp, nil
 }
 
@@ -318,7 +528,7 @@ func appendDeviceID(baseURL, deviceID string) string {
 	}
 	u, err := url.Parse(baseURL)
 	if err != nil {
-		log.Printf("Error parsing URL: %v", err)
+		logger.Error("Error parsing URL", "err", err)
 		return baseURL
 	}
 	q := u.Query()
@@ -327,12 +537,27 @@ func appendDeviceID(baseURL, deviceID string) string {
 	return u.String()
 }
 
-func (sp *Spotify) setVolume(deviceID string, volumePercent int, supportsVolume bool) (*http.Response, error) {
+// errVolumeUnsupported is returned by setVolume for devices that report
+// supports_volume=false. Spotify offers no other way to set their volume (the
+// Connect transfer call takes no volume hint), so callers should surface it
+// rather than retry.
+var errVolumeUnsupported = errors.New("volume not supported on this device")
+
+// setVolume is the single place that decides whether a device's volume can be
+// changed; every caller goes through it and checks for errVolumeUnsupported.
+func (sp *Spotify) setVolume(ctx context.Context, deviceID string, volumePercent int, supportsVolume bool) (*http.Response, error) {
 	if !supportsVolume {
-		return nil, fmt.Errorf("device doesn't support volume")
+		return nil, errVolumeUnsupported
 	}
 
-	log.Printf("Setting volume to %d on device %s", volumePercent, deviceID)
+	// Callers validate the range; clamp anything that slips through rather
+	// than let Spotify reject it.
+	if clamped := min(max(volumePercent, 0), 100); clamped != volumePercent {
+		logger.Warn("Clamping volume out of range", "volume", volumePercent, "clamped", clamped)
+		volumePercent = clamped
+	}
+
+	logger.Debug("Setting volume", "volume", volumePercent, "device_id", deviceID)
 
 	baseUrl := "https://api.spotify.com/v1/me/player/volume"
 	params := url.Values{}
@@ -343,15 +568,15 @@ func (sp *Spotify) setVolume(deviceID string, volumePercent int, supportsVolume
 
 	urlStr := baseUrl + "?" + params.Encode()
 
-	return sp.makeRequest("PUT", urlStr)
+	return sp.makeRequest(ctx, "PUT", urlStr)
 }
 
-func (sp *Spotify) searchPlaylist(query string) (string, string, error) {
+func (sp *Spotify) searchPlaylist(ctx context.Context, query string) (string, string, error) {
 	if strings.TrimSpace(query) == "" {
 		return "", "", fmt.Errorf("query is required")
 	}
 
-	resp, err := sp.makeRequest("GET", buildSpotifySearchURL(query, "playlist", 1))
+	resp, err := sp.makeRequest(ctx, "GET", buildSpotifySearchURL(query, "playlist", 1))
 	if err != nil {
 		return "", "", err
 	}
@@ -369,8 +594,31 @@ func (sp *Spotify) searchPlaylist(query string) (string, string, error) {
 	return firstPlaylistURIFromSearchResponse(body)
 }
 
-func (sp *Spotify) playPlaylist(device *Device, contextUri string, volumePercent int, args ...int) (*http.Response, error) {
-	log.Printf("Playing list with URI %s", contextUri)
+// search returns the name and URI of up to limit results of searchType
+// (track, playlist or album) matching query.
+func (sp *Spotify) search(ctx context.Context, query, searchType string, limit int) ([]searchResult, error) {
+	resp, err := sp.makeRequest(ctx, "GET", buildSpotifySearchURL(query, searchType, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading Spotify search response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Spotify search failed (%d): %s", resp.StatusCode, string(body))
+	}
+
+	return searchResultsFromResponse(body, searchType)
+}
+
+// playPlaylist starts contextUri on device at volumePercent; a negative
+// volume leaves the device's volume unchanged.
+func (sp *Spotify) playPlaylist(ctx context.Context, device *Device, contextUri string, volumePercent int, args ...int) (*http.Response, error) {
+	logger.Info("Playing list", "uri", contextUri)
 
 	deviceID := ""
 	supportsVolume := false
@@ -388,35 +636,29 @@ func (sp *Spotify) playPlaylist(device *Device, contextUri string, volumePercent
 			"position": args[0],
 		}
 	} else {
-		id, err := parsePlaylistId(contextUri)
-
-		if err == nil {
-			// Get the length of the playlist to select a random track
-			baseUrl := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s", id)
-			query := url.Values{
-				"fields": {"tracks"},
-				"limit":  {"1"},
-				"offset": {"0"},
-			}
-			urlStr := baseUrl + "?" + query.Encode()
-
-			resp, err := sp.makeRequest("GET", urlStr)
+		// Artists have no fixed track list to pick from; Spotify starts their
+		// radio itself.
+		kind, id, err := parseContextId(contextUri)
 
+		if err == nil && (kind == "playlist" || kind == "album") {
+			// Get the length of the context to select a random track
+			total, known, err := sp.contextTrackCount(ctx, kind, id)
 			if err != nil {
-				return nil, fmt.Errorf("Failed to marshal the response body while retrieving the playlist: %w", err)
-			}
-
-			var playlist Playlist
-
-			err = json.NewDecoder(resp.Body).Decode(&playlist)
-			resp.Body.Close()
-			if err != nil {
-				log.Printf("Failed to decode response: %s", err)
 				return nil, err
 			}
+			if known && total == 0 {
+				return nil, fmt.Errorf("%s %s has no tracks", kind, contextUri)
+			}
+			if !known {
+				logger.Warn("Could not read the track count, starting from the first track", "kind", kind, "uri", contextUri)
+			}
 
+			position := 0
+			if total > 0 {
+				position = rand.Intn(total)
+			}
 			requestBody["offset"] = map[string]int{
-				"position": rand.Intn(playlist.Tracks.Total),
+				"position": position,
 			}
 		}
 	}
@@ -432,74 +674,149 @@ func (sp *Spotify) playPlaylist(device *Device, contextUri string, volumePercent
 
 	urlStr := appendDeviceID(PlayEndpoint, deviceID)
 
-	if supportsVolume {
-		sp.setVolume(deviceID, volumePercent, supportsVolume)
+	if volumePercent >= 0 {
+		if resp, err := sp.setVolume(ctx, deviceID, volumePercent, supportsVolume); err == nil {
+			resp.Body.Close()
+		} else if !errors.Is(err, errVolumeUnsupported) {
+			logger.Warn("Failed to set volume before playing", "err", err)
+		}
 	}
 
+	// Runs past the request, so it must not be cancelled with it.
+	detached := context.WithoutCancel(ctx)
 	go func() {
-		time.Sleep(5 * time.Second)
-		sp.toggleShuffle(deviceID, true)
-		sp.enableRepeat(deviceID, "context")
+		if err := sleep(detached, 5*time.Second); err != nil {
+			return
+		}
+		if err := sp.toggleShuffle(detached, deviceID, true); err != nil {
+			logger.Warn("Failed to enable shuffle", "err", err)
+		}
+		if err := sp.enableRepeat(detached, deviceID, "context"); err != nil {
+			logger.Warn("Failed to enable repeat", "err", err)
+		}
 	}()
 
-	return sp.makeRequest("PUT", urlStr, jsonBody)
+	return sp.makeRequest(ctx, "PUT", urlStr, jsonBody)
 }
 
-func (sp *Spotify) playPlayback(deviceID string) (*http.Response, error) {
+func (sp *Spotify) playPlayback(ctx context.Context, deviceID string) (*http.Response, error) {
 	urlStr := appendDeviceID(PlayEndpoint, deviceID)
 
-	return sp.makeRequest("PUT", urlStr)
+	return sp.makeRequest(ctx, "PUT", urlStr)
+}
+
+func (sp *Spotify) nextTrack(ctx context.Context, deviceID string) (*http.Response, error) {
+	baseUrl := "https://api.spotify.com/v1/me/player/next"
+
+	urlStr := appendDeviceID(baseUrl, deviceID)
+
+	return sp.makeRequest(ctx, "POST", urlStr)
+}
+
+func (sp *Spotify) previousTrack(ctx context.Context, deviceID string) (*http.Response, error) {
+	baseUrl := "https://api.spotify.com/v1/me/player/previous"
+
+	urlStr := appendDeviceID(baseUrl, deviceID)
+
+	return sp.makeRequest(ctx, "POST", urlStr)
+}
+
+func (sp *Spotify) seek(ctx context.Context, deviceID string, positionMs int) (*http.Response, error) {
+	baseUrl := fmt.Sprintf("https://api.spotify.com/v1/me/player/seek?position_ms=%d", positionMs)
+
+	urlStr := appendDeviceID(baseUrl, deviceID)
+
+	return sp.makeRequest(ctx, "PUT", urlStr)
+}
+
+func (sp *Spotify) addToQueue(ctx context.Context, deviceID, uri string) (*http.Response, error) {
+	params := url.Values{}
+	params.Set("uri", uri)
+
+	urlStr := appendDeviceID(UserQueueEndpoint+"?"+params.Encode(), deviceID)
+
+	return sp.makeRequest(ctx, "POST", urlStr)
+}
+
+// saveTracks adds tracks to the user's Liked Songs. Needs the
+// user-library-modify scope.
+func (sp *Spotify) saveTracks(ctx context.Context, ids ...string) (*http.Response, error) {
+	params := url.Values{}
+	params.Set("ids", strings.Join(ids, ","))
+
+	return sp.makeRequest(ctx, "PUT", SavedTracksEndpoint+"?"+params.Encode())
 }
 
-func (sp *Spotify) pausePlayback(deviceID string) (*http.Response, error) {
+func (sp *Spotify) pausePlayback(ctx context.Context, deviceID string) (*http.Response, error) {
 	baseUrl := "https://api.spotify.com/v1/me/player/pause"
 
 	urlStr := appendDeviceID(baseUrl, deviceID)
 
-	return sp.makeRequest("PUT", urlStr)
+	return sp.makeRequest(ctx, "PUT", urlStr)
 }
 
-func getEnvFromDeviceName(deviceName string) *Spotify {
+func getEnvFromDeviceName(ctx context.Context, deviceName string) *Spotify {
 	if deviceName == "" {
 		return nil
 	}
 
-	log.Printf("Retrieving data for device name: %s\n", deviceName)
+	logger.Debug("Retrieving env for device", "device_name", deviceName)
 
 	// Loop through environments checking device lists
-	for _, env := range envs {
-		if len(env.Devices) == 0 {
-			err := env.updateDevicesData()
+	for _, env := range allEnvs() {
+		if env.deviceCount() == 0 {
+			err := env.updateDevicesData(ctx)
 			if err != nil {
-				log.Printf("Error retrieving devices data: %s\n", err)
+				logger.Warn("Error retrieving devices data", "env", env.Name, "err", err)
 			}
 		}
-		for _, device := range env.Devices {
-			if device.Name == deviceName {
-				log.Println("Device name found, returning instance")
-				return env
-			}
+		if env.hasDevice(deviceName) {
+			logger.Debug("Device found", "device_name", deviceName, "env", env.Name)
+			return env
 		}
 	}
 
 	return nil
 }
 
+// refreshToken gets a new access token. When another refresh finished while
+// this one waited for its turn, that token is returned instead.
 func (sp *Spotify) refreshToken() (string, error) {
+	seen := sp.getTokens()
+
+	sp.refreshMu.Lock()
+	defer sp.refreshMu.Unlock()
+
+	if tokens := sp.getTokens(); tokens != seen && tokens != nil && !tokens.needsRefresh(time.Now()) {
+		return tokens.AccessToken, nil
+	}
+	return sp.refreshTokenLocked()
+}
 
-	if sp.tokens == nil {
+// refreshTokenLocked does the refresh; the caller holds refreshMu.
+func (sp *Spotify) refreshTokenLocked() (string, error) {
+	tokens := sp.getTokens()
+	if tokens == nil {
 		return "", fmt.Errorf("no tokens loaded for env %q", sp.Name)
 	}
 
 	// Use url.Values for proper form encoding
 	data := url.Values{
 		"grant_type":    {"refresh_token"},
-		"refresh_token": {sp.tokens.RefreshToken},
+		"refresh_token": {tokens.RefreshToken},
 		"client_id":     {sp.ClientId},
-		"client_secret": {sp.ClientSecret},
 	}
+	if !sp.UsePKCE {
+		data.Set("client_secret", sp.ClientSecret)
+	}
+
+	// Not tied to the caller's context: a refresh cut off after Spotify
+	// rotated a PKCE refresh token would lose the new one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST",
 		"https://accounts.spotify.com/api/token",
 		strings.NewReader(data.Encode()),
@@ -510,8 +827,7 @@ func (sp *Spotify) refreshToken() (string, error) {
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("executing request: %w", err)
 	}
@@ -524,9 +840,10 @@ func (sp *Spotify) refreshToken() (string, error) {
 	}
 
 	var tokenResp struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		ExpiresIn   int    `json:"expires_in"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
@@ -537,31 +854,57 @@ func (sp *Spotify) refreshToken() (string, error) {
 		return "", fmt.Errorf("no access token in response")
 	}
 
-	sp.tokens.AccessToken = tokenResp.AccessToken
+	// PKCE refresh tokens are single use; Spotify sends the next one.
+	refreshToken := tokens.RefreshToken
+	if tokenResp.RefreshToken != "" {
+		refreshToken = tokenResp.RefreshToken
+	}
 
-	// Update file with new tokens
-	if err := writeTokensToFile(&Tokens{
+	refreshed := &Tokens{
 		AccessToken:  tokenResp.AccessToken,
-		RefreshToken: sp.tokens.RefreshToken,
-	}, sp.tokensFilePath); err != nil {
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt(tokenResp.ExpiresIn),
+	}
+	sp.setTokens(refreshed)
+
+	// Update file with new tokens
+	if err := writeTokensToFile(refreshed, sp.tokensFilePath); err != nil {
 		return "", fmt.Errorf("writing tokens: %w", err)
 	}
 
 	return tokenResp.AccessToken, nil
 }
 
-func (sp *Spotify) toggleShuffle(deviceID string, state bool) {
-	stateStr := ""
-	if state {
-		stateStr = "true"
-	} else {
-		stateStr = "false"
+// refreshTokenIfNeeded refreshes the access token only when it is about to
+// expire, so per-request callers don't hit the token endpoint every time.
+func (sp *Spotify) refreshTokenIfNeeded() error {
+	tokens := sp.getTokens()
+	if tokens != nil && !tokens.needsRefresh(time.Now()) {
+		return nil
 	}
 
-	baseUrl := fmt.Sprintf("https://api.spotify.com/v1/me/player/shuffle?state=%s", stateStr)
+	sp.refreshMu.Lock()
+	defer sp.refreshMu.Unlock()
+
+	// Another request may have refreshed while this one waited.
+	if tokens := sp.getTokens(); tokens != nil && !tokens.needsRefresh(time.Now()) {
+		return nil
+	}
+	_, err := sp.refreshTokenLocked()
+	return err
+}
+
+func (sp *Spotify) toggleShuffle(ctx context.Context, deviceID string, state bool) error {
+	baseUrl := fmt.Sprintf("https://api.spotify.com/v1/me/player/shuffle?state=%s", strconv.FormatBool(state))
 	urlStr := appendDeviceID(baseUrl, deviceID)
 
-	sp.makeRequest("PUT", urlStr)
+	resp, err := sp.makeRequest(ctx, "PUT", urlStr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return playbackError(resp)
 }
 
 // Possibles states:
@@ -570,21 +913,50 @@ func (sp *Spotify) toggleShuffle(deviceID string, state bool) {
 // context will repeat the current context.
 // off will turn repeat off.
 // Example: state=context
-func (sp *Spotify) enableRepeat(deviceID, state string) {
+func (sp *Spotify) enableRepeat(ctx context.Context, deviceID, state string) error {
 	baseUrl := fmt.Sprintf("https://api.spotify.com/v1/me/player/repeat?state=%s", state)
 
 	urlStr := appendDeviceID(baseUrl, deviceID)
 
-	sp.makeRequest("PUT", urlStr)
+	resp, err := sp.makeRequest(ctx, "PUT", urlStr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return playbackError(resp)
 }
 
-func (sp *Spotify) getCurrentPlayback() (*Playback, error) {
-	log.Println("Getting current playback")
+// validRepeatState reports whether state is one enableRepeat accepts.
+func validRepeatState(state string) bool {
+	switch state {
+	case "track", "context", "off":
+		return true
+	}
+	return false
+}
 
-	resp, err := sp.makeRequest("GET", CurrentPlaybackEndpoint)
+func (sp *Spotify) getCurrentPlayback(ctx context.Context) (*Playback, error) {
+	logger.Debug("Getting current playback", "env", sp.Name)
+
+	resp, err := sp.makeRequest(ctx, "GET", CurrentPlaybackEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("making request: %w", err)
 	}
+
+	// A transient 5xx would otherwise abort the alarm/transfer flows; retry once.
+	if resp.StatusCode >= http.StatusInternalServerError {
+		logger.Warn("Spotify failed to return the current playback, retrying once", "status", resp.StatusCode)
+		resp.Body.Close()
+		if err := sleep(ctx, playbackRetryDelay); err != nil {
+			return nil, err
+		}
+
+		resp, err = sp.makeRequest(ctx, "GET", CurrentPlaybackEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("making request: %w", err)
+		}
+	}
 	defer resp.Body.Close()
 
 	// Handle 204 No Content - means no active playback
@@ -602,14 +974,14 @@ func (sp *Spotify) getCurrentPlayback() (*Playback, error) {
 		return nil, fmt.Errorf("decoding playback response: %w", err)
 	}
 
-	log.Printf("Playback found: %+v", playback)
+	logger.Debug("Playback found", "playback", playback)
 	return &playback, nil
 }
 
-func (sp *Spotify) getUserQueue() (*UserQueue, error) {
-	log.Println("Getting user queue")
+func (sp *Spotify) getUserQueue(ctx context.Context) (*UserQueue, error) {
+	logger.Debug("Getting user queue", "env", sp.Name)
 
-	resp, err := sp.makeRequest("GET", UserQueueEndpoint)
+	resp, err := sp.makeRequest(ctx, "GET", UserQueueEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("making request: %w", err)
 	}
@@ -630,12 +1002,76 @@ func (sp *Spotify) getUserQueue() (*UserQueue, error) {
 		return nil, fmt.Errorf("decoding playback response: %w", err)
 	}
 
-	log.Printf("User queue found: %+v", userQueue)
+	logger.Debug("User queue found", "queue", userQueue)
 	return &userQueue, nil
 }
 
-// Migrate callback from one account to anoter
-func (sp *Spotify) transferPlayback(to *Spotify, toDevice *Device) error {
+func (sp *Spotify) getRecentlyPlayed(ctx context.Context, limit int) (*PlayHistory, error) {
+	logger.Debug("Getting recently played tracks", "env", sp.Name, "limit", limit)
+
+	resp, err := sp.makeRequest(ctx, "GET", RecentlyPlayedEndpoint+"?limit="+strconv.Itoa(limit))
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		printResponseBody(resp)
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var recent PlayHistory
+	if err := json.NewDecoder(resp.Body).Decode(&recent); err != nil {
+		return nil, fmt.Errorf("decoding recently played response: %w", err)
+	}
+
+	return &recent, nil
+}
+
+// activateDevice moves the session to deviceID without starting playback,
+// then waits until Spotify lists it as active. A device woken from idle takes
+// a moment to register, and a play sent before that is rejected.
+func (sp *Spotify) activateDevice(ctx context.Context, deviceID string) error {
+	body, err := json.Marshal(map[string]any{
+		"device_ids": []string{deviceID},
+		"play":       false,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	resp, err := sp.makeRequest(ctx, "PUT", CurrentPlaybackEndpoint, body)
+	if err != nil {
+		return err
+	}
+	err = playbackError(resp)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("activating device: %w", err)
+	}
+
+	for range activationAttempts {
+		devices, err := sp.fetchDevices(ctx)
+		if err != nil {
+			return err
+		}
+		for _, device := range devices {
+			if device.ID == deviceID && device.IsActive {
+				return nil
+			}
+		}
+		if err := sleep(ctx, activationPollDelay); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("device %s did not become active", deviceID)
+}
+
+// Migrate callback from one account to anoter. With fade set and both devices
+// supporting volume, the source ramps down while the destination ramps up
+// instead of an abrupt pause-then-play; within one account there is no fade.
+func (sp *Spotify) transferPlayback(ctx context.Context, to *Spotify, toDevice *Device, fade bool) error {
 	if to == nil {
 		return fmt.Errorf("destination Spotify instance is nil")
 	}
@@ -645,22 +1081,22 @@ func (sp *Spotify) transferPlayback(to *Spotify, toDevice *Device) error {
 		toDeviceID = toDevice.ID
 	}
 
-	playback, err := sp.getCurrentPlayback()
+	playback, err := sp.getCurrentPlayback(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get current playback: %w", err)
 	}
 
-	userQueue, err := sp.getUserQueue()
+	userQueue, err := sp.getUserQueue(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get user queue: %w", err)
 	}
 
 	if len(userQueue.Queue) == 0 || !playback.IsPlaying {
-		fmt.Println("There are no items in the Playing/Queue")
+		logger.Info("Nothing to transfer: no playback or empty queue", "env", sp.Name)
 		return nil
 	}
 
-	log.Println("Making list of Uris")
+	logger.Debug("Making list of Uris")
 
 	// Queue + current track
 	uris := make([]string, 0, len(userQueue.Queue)+1)
@@ -680,22 +1116,111 @@ func (sp *Spotify) transferPlayback(to *Spotify, toDevice *Device) error {
 		}
 	}
 
-	log.Printf("Uris: %v\n", uris)
+	logger.Debug("Uris", "uris", uris)
+
+	// Within one account Spotify moves the playback itself once the
+	// destination plays, so fading out and pausing the source would pause the
+	// destination.
+	if fade && sp.Name == to.Name {
+		logger.Info("Source and destination share an account, transferring without a fade", "env", sp.Name)
+		fade = false
+	}
+
+	if fade && playback.Device.SupportsVolume && toDevice != nil && toDevice.SupportsVolume {
+		return sp.fadeHandoff(ctx, to, &playback.Device, toDeviceID, uris, playback.ProgressMs)
+	}
 
 	// First pause current playback
-	if err := sp.pauseCurrentPlayback(); err != nil {
+	if err := sp.pauseCurrentPlayback(ctx); err != nil {
 		return fmt.Errorf("failed to pause current playback: %w", err)
 	}
 
-	log.Println("Playing on another device...")
-	if _, err = to.playUris(toDeviceID, uris, playback.ProgressMs); err != nil {
+	logger.Info("Playing on another device", "from", sp.Name, "to", to.Name)
+	if _, err = to.playUris(ctx, toDeviceID, uris, playback.ProgressMs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// fadeHandoff starts the uris silently on the destination, then fades the
+// source out while fading the destination in to the source's volume.
+func (sp *Spotify) fadeHandoff(ctx context.Context, to *Spotify, source *Device, toDeviceID string, uris []string, positionMs int) error {
+	volume := source.VolumenPercent
+
+	resp, err := to.setVolume(ctx, toDeviceID, 0, true)
+	if err != nil {
+		return fmt.Errorf("failed to mute destination: %w", err)
+	}
+	resp.Body.Close()
+
+	logger.Info("Fading playback over to another device", "from", sp.Name, "to", to.Name)
+	if _, err := to.playUris(ctx, toDeviceID, uris, positionMs); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var outErr, inErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		outErr = sp.fadeOutAndPause(ctx, source.ID, volume)
+	}()
+	go func() {
+		defer wg.Done()
+		inErr = to.fadeVolume(ctx, toDeviceID, 0, volume, handoffDuration)
+	}()
+	wg.Wait()
+
+	return errors.Join(outErr, inErr)
+}
+
+// fadeVolume steps a device's volume from `from` to `to` over duration in
+// fadeSteps increments.
+func (sp *Spotify) fadeVolume(ctx context.Context, deviceID string, from, to int, duration time.Duration) error {
+	interval := duration / fadeSteps
+	for i := 1; i <= fadeSteps; i++ {
+		resp, err := sp.setVolume(ctx, deviceID, from+(to-from)*i/fadeSteps, true)
+		if err != nil {
+			return fmt.Errorf("fading volume: %w", err)
+		}
+		resp.Body.Close()
+
+		if i < fadeSteps {
+			if err := sleep(ctx, interval); err != nil {
+				return fmt.Errorf("fading volume: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// fadeOutAndPause fades the device to silence, pauses it and then restores its
+// volume so the next playback there isn't muted.
+func (sp *Spotify) fadeOutAndPause(ctx context.Context, deviceID string, volume int) error {
+	if err := sp.fadeVolume(ctx, deviceID, volume, 0, handoffDuration); err != nil {
 		return err
 	}
 
+	resp, err := sp.pausePlayback(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to pause source: %w", err)
+	}
+	err = playbackError(resp)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to pause source: %w", err)
+	}
+
+	resp, err = sp.setVolume(ctx, deviceID, volume, true)
+	if err != nil {
+		return fmt.Errorf("failed to restore source volume: %w", err)
+	}
+	resp.Body.Close()
 	return nil
 }
 
-func (sp *Spotify) playUris(deviceID string, uris []string, positionMs int) (*http.Response, error) {
+func (sp *Spotify) playUris(ctx context.Context, deviceID string, uris []string, positionMs int) (*http.Response, error) {
 	if len(uris) == 0 {
 		return nil, fmt.Errorf("no URIs provided")
 	}
@@ -711,11 +1236,11 @@ func (sp *Spotify) playUris(deviceID string, uris []string, positionMs int) (*ht
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	log.Printf("Attempting to play %d track(s) at position %d ms", len(uris), positionMs)
+	logger.Info("Attempting to play tracks", "count", len(uris), "position_ms", positionMs)
 
 	urlStr := appendDeviceID(PlayEndpoint, deviceID)
 
-	resp, err := sp.makeRequest("PUT", urlStr, jsonBody)
+	resp, err := sp.makeRequest(ctx, "PUT", urlStr, jsonBody)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to start playback on destination: %w", err)
@@ -733,8 +1258,8 @@ func (sp *Spotify) playUris(deviceID string, uris []string, positionMs int) (*ht
 
 // Helper method to pause current playback with proper error handling.
 // Passing an empty deviceID pauses whichever device is currently active.
-func (sp *Spotify) pauseCurrentPlayback() error {
-	resp, err := sp.pausePlayback("")
+func (sp *Spotify) pauseCurrentPlayback(ctx context.Context) error {
+	resp, err := sp.pausePlayback(ctx, "")
 	if err != nil {
 		return err
 	}
@@ -749,29 +1274,40 @@ func (sp *Spotify) pauseCurrentPlayback() error {
 	return nil
 }
 
-func (sp *Spotify) hardTransferPlayback(to *Spotify, toDevice *Device, volume int) error {
+// getCurrentVolume reads the active device's volume from the live device
+// list. ok is false when no device is active or it has no volume control.
+func (sp *Spotify) getCurrentVolume(ctx context.Context) (volume int, ok bool) {
+	devices, err := sp.fetchDevices(ctx)
+	if err != nil {
+		logger.Warn("Failed to read devices for the current volume", "env", sp.Name, "err", err)
+		return 0, false
+	}
+
+	for _, device := range devices {
+		if device.IsActive {
+			return device.VolumenPercent, device.SupportsVolume
+		}
+	}
+	return 0, false
+}
+
+func (sp *Spotify) hardTransferPlayback(ctx context.Context, to *Spotify, toDevice *Device, volume int) error {
 	if to == nil {
 		return fmt.Errorf("destination Spotify instance is nil")
 	}
 
-	playback, err := sp.getCurrentPlayback()
+	playback, err := sp.getCurrentPlayback(ctx)
 
 	if err != nil {
 		return fmt.Errorf("error retrieving currrent playback: %s", err)
 	}
 
-	// Try to get the volume if it is not set
-	if volume == 0 {
-		if playback.Device.SupportsVolume {
-			// Get the volume if it is supported
-			volume = playback.Device.VolumenPercent
-		} else {
-			volume = 50 // Default
-		}
-	}
+	// Carry the source volume over when none was requested
+	sourceVolume, sourceKnown := sp.getCurrentVolume(ctx)
+	volume = transferVolume(volume, sourceVolume, sourceKnown)
 
 	// Transfer current track
-	err = sp.pauseCurrentPlayback()
+	err = sp.pauseCurrentPlayback(ctx)
 	if err != nil {
 		return fmt.Errorf("error pausing current playback")
 	}
@@ -780,8 +1316,8 @@ func (sp *Spotify) hardTransferPlayback(to *Spotify, toDevice *Device, volume in
 		return fmt.Errorf("There is no context currently playing.")
 	}
 
-	trackNumber := to.getTrackNumber(playback.Context.Uri, playback.Item.Name)
-	resp, err := to.playPlaylist(toDevice, playback.Context.Uri, volume, trackNumber, playback.ProgressMs)
+	trackNumber := to.getTrackNumber(ctx, playback.Context.Uri, playback.Item.Name)
+	resp, err := to.playPlaylist(ctx, toDevice, playback.Context.Uri, volume, trackNumber, playback.ProgressMs)
 
 	if err != nil {
 		return fmt.Errorf("error playing uris: %s", err)
@@ -792,14 +1328,65 @@ func (sp *Spotify) hardTransferPlayback(to *Spotify, toDevice *Device, volume in
 	return nil
 }
 
-func (sp *Spotify) getTrackNumber(playlistUri, trackName string) int {
+// contextTrackCount asks Spotify how many tracks a playlist or album has.
+// known is false when Spotify did not answer with a count.
+func (sp *Spotify) contextTrackCount(ctx context.Context, kind, id string) (total int, known bool, err error) {
+	var urlStr string
+	switch kind {
+	case "playlist":
+		query := url.Values{
+			"fields": {"tracks"},
+			"limit":  {"1"},
+			"offset": {"0"},
+		}
+		urlStr = fmt.Sprintf("https://api.spotify.com/v1/playlists/%s?%s", id, query.Encode())
+	case "album":
+		urlStr = fmt.Sprintf("https://api.spotify.com/v1/albums/%s/tracks?limit=1", id)
+	default:
+		return 0, false, fmt.Errorf("%s has no track count", kind)
+	}
+
+	resp, err := sp.makeRequest(ctx, "GET", urlStr)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to marshal the response body while retrieving the %s: %w", kind, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Warn("Reading the context failed", "kind", kind, "id", id, "status", resp.StatusCode)
+		return 0, false, nil
+	}
+
+	if kind == "album" {
+		var page struct {
+			Total int `json:"total"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			logger.Warn("Failed to decode response", "err", err)
+			return 0, false, err
+		}
+		return page.Total, true, nil
+	}
+
+	var playlist Playlist
+	if err := json.NewDecoder(resp.Body).Decode(&playlist); err != nil {
+		logger.Warn("Failed to decode response", "err", err)
+		return 0, false, err
+	}
+	return playlist.Tracks.Total, true, nil
+}
+
+func (sp *Spotify) getTrackNumber(ctx context.Context, playlistUri, trackName string) int {
 	if playlistUri == "" || trackName == "" {
 		return 0
 	}
 
-	playlistId, err := parsePlaylistId(playlistUri)
+	kind, playlistId, err := parseContextId(playlistUri)
 	if err != nil {
-		log.Printf("Error parsing playlist id: %s", err)
+		logger.Warn("Error parsing playlist id", "err", err)
+		return 0
+	}
+	if kind != "playlist" {
 		return 0
 	}
 
@@ -827,9 +1414,9 @@ func (sp *Spotify) getTrackNumber(playlistUri, trackName string) int {
 		query.Set("offset", strconv.Itoa(offset))
 		urlStr := baseUrl + "?" + query.Encode()
 
-		resp, err := sp.makeRequest("GET", urlStr)
+		resp, err := sp.makeRequest(ctx, "GET", urlStr)
 		if err != nil {
-			log.Printf("Failed to fetch tracks: %s", err)
+			logger.Warn("Failed to fetch tracks", "err", err)
 			return 0
 		}
 
@@ -837,7 +1424,7 @@ func (sp *Spotify) getTrackNumber(playlistUri, trackName string) int {
 		err = json.NewDecoder(resp.Body).Decode(&page)
 		resp.Body.Close()
 		if err != nil {
-			log.Printf("Failed to decode response: %s", err)
+			logger.Warn("Failed to decode response", "err", err)
 			return 0
 		}
 
@@ -1,22 +1,93 @@
 package spotify
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Update the current active environment
 func updateEnv(newEnv *Spotify) {
-	log.Println(fmt.Sprintf("Settings environment to %v", newEnv))
-	currentEnv = newEnv
+	logger.Info("Setting environment", "env", newEnv)
+	setCurrentEnv(newEnv)
+}
+
+func getCurrentEnv() *Spotify {
+	envsMu.RLock()
+	defer envsMu.RUnlock()
+	return currentEnv
+}
+
+func setCurrentEnv(sp *Spotify) {
+	envsMu.Lock()
+	defer envsMu.Unlock()
+	currentEnv = sp
+}
+
+// initEnvs creates the Home and Main envs if they don't exist yet. Requests
+// do it in SpotifyMiddleware; scheduled tasks restored after a restart do it
+// when they fire.
+func initEnvs() {
+	if getEnv(Home) == nil {
+		new(Home)
+	}
+	if getEnv(Main) == nil {
+		new(Main)
+	}
+}
+
+func getEnv(name string) *Spotify {
+	envsMu.RLock()
+	defer envsMu.RUnlock()
+	return envs[name]
+}
+
+// allEnvs returns a snapshot of the non-nil environments, safe to range over
+// while other requests update the map.
+func allEnvs() map[string]*Spotify {
+	envsMu.RLock()
+	defer envsMu.RUnlock()
+
+	snapshot := make(map[string]*Spotify, len(envs))
+	for name, sp := range envs {
+		if sp != nil {
+			snapshot[name] = sp
+		}
+	}
+	return snapshot
+}
+
+// replaceEnvs swaps in a new set of environments, re-pointing currentEnv at
+// the env of the same name. apply, if not nil, runs under the same lock, so
+// the settings it changes land together with the envs built from them.
+func replaceEnvs(fresh map[string]*Spotify, apply func()) {
+	envsMu.Lock()
+	defer envsMu.Unlock()
+
+	if apply != nil {
+		apply()
+	}
+
+	current := ""
+	if currentEnv != nil {
+		current = currentEnv.Name
+	}
+	envs = fresh
+	if current != "" {
+		currentEnv = envs[current]
+	}
 }
 
 // Write tokens to a file for storage them
@@ -29,28 +100,46 @@ func writeTokensToFile(tokensLines *Tokens, fileName string) error {
 		os.MkdirAll(dirName, os.ModePerm)
 	}
 
-	log.Println(fmt.Sprintf("Writing tokens to file %s", fileName))
+	logger.Debug("Writing tokens to file", "file", fileName)
 
-	tokens := []string{
-		"access_token:" + tokensLines.AccessToken,
-		"refresh_token:" + tokensLines.RefreshToken,
+	data, err := json.Marshal(tokensLines)
+	if err != nil {
+		return err
 	}
-
-	data := []byte(strings.Join(tokens, "\n") + "\n")
 	return os.WriteFile(fileName, data, 0600)
 }
 
+// readTokensFromFile reads tokens stored as JSON, or in the older
+// key:value line format so files written before the switch still load.
 func readTokensFromFile(fileName string) (*Tokens, error) {
 	data, err := os.ReadFile(fileName)
-	result := Tokens{}
 
-	log.Printf("Reading tokens from file %s", fileName)
+	logger.Debug("Reading tokens from file", "file", fileName)
 
 	if err != nil {
 		return nil, err
 	}
 
-	dataStr := string(data)
+	var result Tokens
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("decoding tokens file %s: %w", fileName, err)
+		}
+	} else {
+		result = parseLegacyTokens(string(data))
+	}
+
+	if result.RefreshToken == "" {
+		return nil, errors.New(fmt.Sprintf("error retrieving data from file: %s", fileName))
+	}
+
+	return &result, nil
+}
+
+// parseLegacyTokens parses the access_token:/refresh_token:/expires_at: line
+// format used before tokens were stored as JSON.
+func parseLegacyTokens(dataStr string) Tokens {
+	result := Tokens{}
 	tokens := strings.SplitSeq(dataStr, "\n")
 
 	for token := range tokens {
@@ -61,39 +150,138 @@ func readTokensFromFile(fileName string) (*Tokens, error) {
 			value := strings.TrimSpace(elements[1])
 
 			if key == "access_token" {
-				log.Println("access token found")
+				logger.Debug("Access token found")
 				result.AccessToken = value
 			} else if key == "refresh_token" {
-				log.Println("refresh token found")
+				logger.Debug("Refresh token found")
 				result.RefreshToken = value
-			}
-			if result.AccessToken != "" && result.RefreshToken != "" {
-				break
+			} else if key == "expires_at" {
+				// Files written before expiry was stored lack this line; the
+				// zero value makes the first request refresh.
+				if expiry, err := time.Parse(time.RFC3339, value); err == nil {
+					result.ExpiresAt = expiry
+				} else {
+					logger.Warn("Ignoring invalid expires_at", "value", value, "err", err)
+				}
 			}
 		}
 	}
 
-	if result.RefreshToken == "" {
-		return nil, errors.New(fmt.Sprintf("error retrieving data from file: %s", fileName))
+	return result
+}
+
+// expiresAt turns an expires_in from Spotify (seconds) into a deadline. A
+// missing value yields the zero time, meaning "refresh before next use".
+func expiresAt(expiresIn int) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
 
-	return &result, nil
+// retryAfter reads a Retry-After header in seconds, capped at
+// rateLimitMaxWait. A missing or unparsable value waits one second.
+func retryAfter(value string) time.Duration {
+	wait := time.Second
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	}
+	return min(wait, rateLimitMaxWait)
+}
+
+// sleep waits for d, giving up early with ctx's error once ctx is done, so a
+// retry or fade doesn't outlive the request that started it.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
-func schedule(epochMillis int64, action func()) {
+// scheduled holds the timers of pending tasks by id so they can be cancelled.
+var (
+	scheduledMu sync.Mutex
+	scheduled   = make(map[string]*time.Timer)
+)
+
+// schedule runs action at epochMillis and returns an id for cancelSchedule.
+// Times in the past are not armed and return "".
+func schedule(epochMillis int64, action func()) string {
 	delayMillis := epochMillis - time.Now().UnixMilli()
 
-	log.Println(fmt.Sprintf("Scheduling task to %d seconds later\n", delayMillis/1000))
+	logger.Info("Scheduling task", "in", time.Duration(delayMillis)*time.Millisecond)
 
 	if delayMillis < 0 {
-		log.Println("epochMillis is in the past in schedule function")
-		return
+		logger.Warn("Not scheduling a task in the past", "epoch_millis", epochMillis)
+		return ""
 	}
 
-	go func() {
-		time.Sleep(time.Duration(delayMillis) * time.Millisecond)
+	id := newScheduleID()
+
+	scheduledMu.Lock()
+	defer scheduledMu.Unlock()
+	scheduled[id] = time.AfterFunc(time.Duration(delayMillis)*time.Millisecond, func() {
+		scheduledMu.Lock()
+		delete(scheduled, id)
+		scheduledMu.Unlock()
+
 		action()
-	}()
+	})
+
+	return id
+}
+
+// cancelSchedule stops a pending task. It reports false when the id is
+// unknown or the task already fired.
+func cancelSchedule(id string) bool {
+	scheduledMu.Lock()
+	defer scheduledMu.Unlock()
+
+	timer, ok := scheduled[id]
+	if !ok {
+		return false
+	}
+	delete(scheduled, id)
+	return timer.Stop()
+}
+
+func newScheduleID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// scheduleHorizon is how far ahead a task may be scheduled, read from
+// SCHEDULE_MAX_HORIZON as a Go duration (e.g. "72h"). Defaults to 7 days.
+func scheduleHorizon() time.Duration {
+	v := os.Getenv("SCHEDULE_MAX_HORIZON")
+	if v == "" {
+		return defaultScheduleHorizon
+	}
+
+	horizon, err := time.ParseDuration(v)
+	if err != nil || horizon <= 0 {
+		logger.Warn("Invalid SCHEDULE_MAX_HORIZON, using the default", "value", v, "default", defaultScheduleHorizon)
+		return defaultScheduleHorizon
+	}
+	return horizon
+}
+
+// validateScheduleDelay rejects tasks in the past or beyond the schedule
+// horizon, so a typo in time_millis can't hold a timer for years.
+func validateScheduleDelay(delay time.Duration) error {
+	if delay < 0 {
+		return fmt.Errorf("time_millis is %s in the past", (-delay).Round(time.Second))
+	}
+	if horizon := scheduleHorizon(); delay > horizon {
+		return fmt.Errorf("time_millis is more than %s ahead", horizon)
+	}
+	return nil
 }
 
 func buildSpotifySearchURL(query, searchType string, limit int) string {
@@ -127,30 +315,300 @@ func firstPlaylistURIFromSearchResponse(body []byte) (string, string, error) {
 	return "", "", fmt.Errorf("no playlist found")
 }
 
+// searchTypes are the result types /search accepts.
+var searchTypes = []string{"track", "playlist", "album"}
+
+// searchResult is one item of a Spotify search.
+type searchResult struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+// searchResultsFromResponse extracts the results of searchType from a search
+// response. Spotify nests them under the plural type, e.g. "tracks".
+func searchResultsFromResponse(body []byte, searchType string) ([]searchResult, error) {
+	var payload map[string]struct {
+		Items []searchResult `json:"items"`
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("decoding Spotify search response: %w", err)
+	}
+
+	// Spotify pads results it can no longer serve with nulls.
+	results := []searchResult{}
+	for _, item := range payload[searchType+"s"].Items {
+		if item.URI != "" {
+			results = append(results, item)
+		}
+	}
+	return results, nil
+}
+
+// defaultScopes are requested for an env that has no <PREFIX>SP_SCOPES set.
+var defaultScopes = []string{
+	"user-read-playback-state",
+	"user-modify-playback-state",
+	"user-read-currently-playing",
+	"app-remote-control",
+	"user-read-recently-played",
+	"user-library-modify",
+}
+
+// knownScopes are the authorization scopes Spotify accepts.
+var knownScopes = map[string]bool{
+	"ugc-image-upload":            true,
+	"user-read-playback-state":    true,
+	"user-modify-playback-state":  true,
+	"user-read-currently-playing": true,
+	"app-remote-control":          true,
+	"streaming":                   true,
+	"playlist-read-private":       true,
+	"playlist-read-collaborative": true,
+	"playlist-modify-private":     true,
+	"playlist-modify-public":      true,
+	"user-follow-modify":          true,
+	"user-follow-read":            true,
+	"user-read-playback-position": true,
+	"user-top-read":               true,
+	"user-read-recently-played":   true,
+	"user-library-modify":         true,
+	"user-library-read":           true,
+	"user-read-email":             true,
+	"user-read-private":           true,
+}
+
+// parseScopes reads a comma- or space-separated scope list. An empty value
+// yields defaultScopes; an unknown scope is an error so a typo is caught at
+// load instead of at the Spotify consent screen.
+func parseScopes(raw string) ([]string, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if len(fields) == 0 {
+		return defaultScopes, nil
+	}
+
+	for _, scope := range fields {
+		if !knownScopes[scope] {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return fields, nil
+}
+
+// authorizeURL builds the Spotify consent URL for this env's client and scopes,
+// carrying the login's state parameter. A non-empty challenge asks for the
+// PKCE flow.
+func (sp *Spotify) authorizeURL(state, challenge string) string {
+	scopes := sp.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	params := url.Values{}
+	params.Set("client_id", sp.ClientId)
+	params.Set("response_type", "code")
+	params.Set("redirect_uri", sp.CallbackUri)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state)
+	if challenge != "" {
+		params.Set("code_challenge", challenge)
+		params.Set("code_challenge_method", "S256")
+	}
+
+	return "https://accounts.spotify.com/authorize?" + params.Encode()
+}
+
+// transferVolume picks the volume a transfer starts the destination at: the
+// requested one, else the source device's, else -1 so the destination keeps
+// its own instead of a guess that may be far too loud.
+func transferVolume(requested, source int, sourceKnown bool) int {
+	if requested > 0 {
+		return requested
+	}
+	if sourceKnown {
+		return source
+	}
+	return -1
+}
+
+// limitQueue caps the upcoming tracks to at most limit items.
+func limitQueue(tracks []Track, limit int) []Track {
+	if len(tracks) > limit {
+		return tracks[:limit]
+	}
+	return tracks
+}
+
+// displayName returns the display alias configured for a raw Spotify device
+// name, or the raw name when there is none. DEVICE_ALIASES holds
+// comma-separated raw=display pairs. Aliases are only for presentation; device
+// resolution always uses the raw name.
+func displayName(rawName string) string {
+	for pair := range strings.SplitSeq(os.Getenv("DEVICE_ALIASES"), ",") {
+		raw, alias, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if strings.TrimSpace(raw) == rawName && strings.TrimSpace(alias) != "" {
+			return strings.TrimSpace(alias)
+		}
+	}
+	return rawName
+}
+
+// playbackSummary is the compact view of a Playback returned by the state
+// endpoints.
+type playbackSummary struct {
+	IsPlaying   bool   `json:"is_playing"`
+	Track       string `json:"track,omitempty"`
+	Uri         string `json:"uri,omitempty"`
+	ProgressMs  int    `json:"progress_ms"`
+	DurationMs  int    `json:"duration_ms"`
+	Device      string `json:"device,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func summarizePlayback(playback *Playback) playbackSummary {
+	summary := playbackSummary{
+		IsPlaying:  playback.IsPlaying,
+		Track:      playback.Item.Name,
+		Uri:        playback.Item.Uri,
+		ProgressMs: playback.ProgressMs,
+		DurationMs: playback.Item.DurationMs,
+		Device:     playback.Device.Name,
+	}
+	if summary.Device != "" {
+		summary.DisplayName = displayName(summary.Device)
+	}
+	return summary
+}
+
+// recentTrack is one entry of the /recent response.
+type recentTrack struct {
+	Track    string    `json:"track"`
+	Artist   string    `json:"artist"`
+	Uri      string    `json:"uri"`
+	PlayedAt time.Time `json:"played_at"`
+}
+
+func summarizeRecent(recent *PlayHistory) []recentTrack {
+	tracks := make([]recentTrack, 0, len(recent.Items))
+	for _, item := range recent.Items {
+		tracks = append(tracks, recentTrack{
+			Track:    item.Track.Name,
+			Artist:   artistNames(item.Track),
+			Uri:      item.Track.Uri,
+			PlayedAt: item.PlayedAt,
+		})
+	}
+	return tracks
+}
+
+// artistNames joins a track's artist names for display.
+func artistNames(track Track) string {
+	names := make([]string, 0, len(track.Artists))
+	for _, artist := range track.Artists {
+		names = append(names, artist.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// closestImage picks the image whose width is nearest to size, or the largest
+// one when size is 0. Returns nil when there are no images.
+func closestImage(images []Image, size int) *Image {
+	var best *Image
+	for i := range images {
+		img := &images[i]
+		if best == nil {
+			best = img
+			continue
+		}
+		if size == 0 {
+			if img.Width > best.Width {
+				best = img
+			}
+			continue
+		}
+		if abs(img.Width-size) < abs(best.Width-size) {
+			best = img
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// playlistAllowed reports whether a context URI may be played. The optional
+// PLAYLIST_ALLOWLIST env var holds a comma-separated list of URIs; when it is
+// unset every URI is allowed.
+func playlistAllowed(uri string) bool {
+	allowList := strings.TrimSpace(os.Getenv("PLAYLIST_ALLOWLIST"))
+	if allowList == "" {
+		return true
+	}
+
+	for allowed := range strings.SplitSeq(allowList, ",") {
+		if strings.TrimSpace(allowed) == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// printResponseBody logs the response body when DEBUG is enabled. The body is
+// buffered and restored so the caller can still read it afterwards.
 func printResponseBody(resp *http.Response) {
+	if !debugMode {
+		return
+	}
+
 	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
 	if err != nil {
-		fmt.Printf("Error decoding body: %s", err)
+		logger.Debug("Error reading response body", "err", err)
 		return
 	}
 
-	fmt.Println(string(body))
+	logger.Debug("Response body", "status", resp.StatusCode, "body", string(body))
 }
 
-// Extract the id from a playlist URI
+// Extract the kind and id from a playlist, album or artist URI
 // Example:
-// parsePlaylistId("spotify:playlist:0qPA1tBtiCLVHCUfREECnO")
-// returns "0qPA1tBtiCLVHCUfREECnO", nil
-func parsePlaylistId(playlistUri string) (string, error) {
-	if !strings.Contains(playlistUri, ":playlist:") {
-		return "", fmt.Errorf("Playlist URI is invalid: %s", playlistUri)
-	}
+// parseContextId("spotify:playlist:0qPA1tBtiCLVHCUfREECnO")
+// returns "playlist", "0qPA1tBtiCLVHCUfREECnO", nil
+func parseContextId(contextUri string) (string, string, error) {
+	parts := strings.Split(contextUri, ":")
 
-	parts := strings.Split(playlistUri, ":")
+	if len(parts) != 3 || parts[0] != "spotify" || parts[2] == "" {
+		return "", "", fmt.Errorf("Context URI is invalid: %s", contextUri)
+	}
 
-	if len(parts) != 3 {
-		return "", fmt.Errorf("Playlist URI is invalid: %s", playlistUri)
+	switch parts[1] {
+	case "playlist", "album", "artist":
+		return parts[1], parts[2], nil
 	}
 
-	return parts[2], nil
+	return "", "", fmt.Errorf("Context URI is invalid: %s", contextUri)
+}
+
+// Extract the id from a track URI
+// Example:
+// parseTrackId("spotify:track:4uLU6hMCjMI75M1A2tKUQC")
+// returns "4uLU6hMCjMI75M1A2tKUQC", nil
+func parseTrackId(trackUri string) (string, error) {
+	id, ok := strings.CutPrefix(trackUri, "spotify:track:")
+	if !ok || id == "" || strings.Contains(id, ":") {
+		return "", fmt.Errorf("Track URI is invalid: %s", trackUri)
+	}
+	return id, nil
 }
@@ -1,7 +1,14 @@
 package spotify
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -34,7 +41,7 @@ func TestWriteTokensToFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	want := "access_token:test_access\nrefresh_token:test_refresh"
+	want := `{"access_token":"test_access","refresh_token":"test_refresh"}`
 	if strings.TrimSpace(string(got)) != want {
 		t.Errorf("got %q, want %q", string(got), want)
 	}
@@ -49,7 +56,7 @@ func TestReadTokensFromFile(t *testing.T) {
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	text := "access_token:test_access\nrefresh_token:test_refresh"
+	text := `{"access_token":"test:access","refresh_token":"test_refresh"}`
 	tempFile.WriteString(text)
 
 	tokens, err := readTokensFromFile(tempFile.Name())
@@ -58,12 +65,70 @@ func TestReadTokensFromFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if tokens.AccessToken != "test_access" {
+	if tokens.AccessToken != "test:access" {
 		t.Fatalf("Incorrect access token: %s", tokens.AccessToken)
 	}
 
 	if tokens.RefreshToken != "test_refresh" {
-		t.Fatalf("Incorrect access token: %s", tokens.AccessToken)
+		t.Fatalf("Incorrect refresh token: %s", tokens.RefreshToken)
+	}
+}
+
+func TestReadLegacyTokensFile(t *testing.T) {
+	path := t.TempDir() + "/.tokens-home.txt"
+	text := "access_token:test_access\nrefresh_token:test_refresh\nexpires_at:2026-01-02T03:04:05Z\n"
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := readTokensFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Tokens{
+		AccessToken:  "test_access",
+		RefreshToken: "test_refresh",
+		ExpiresAt:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if tokens.AccessToken != want.AccessToken || tokens.RefreshToken != want.RefreshToken || !tokens.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("readTokensFromFile() = %+v, want %+v", *tokens, want)
+	}
+}
+
+func TestTokenExpiryRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/tokens.txt"
+	expiry := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := writeTokensToFile(&Tokens{AccessToken: "a", RefreshToken: "r", ExpiresAt: expiry}, path); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := readTokensFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokens.ExpiresAt.Equal(expiry) {
+		t.Errorf("ExpiresAt = %v, want %v", tokens.ExpiresAt, expiry)
+	}
+}
+
+func TestTokensNeedRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		want      bool
+	}{
+		{name: "unknown expiry", want: true},
+		{name: "expired", expiresAt: now.Add(-time.Minute), want: true},
+		{name: "inside margin", expiresAt: now.Add(30 * time.Second), want: true},
+		{name: "fresh", expiresAt: now.Add(30 * time.Minute), want: false},
+	}
+	for _, tt := range tests {
+		tokens := Tokens{AccessToken: "a", ExpiresAt: tt.expiresAt}
+		if got := tokens.needsRefresh(now); got != tt.want {
+			t.Errorf("%s: needsRefresh = %v, want %v", tt.name, got, tt.want)
+		}
 	}
 }
 
@@ -110,18 +175,62 @@ func TestSchedule(t *testing.T) {
 	}
 }
 
+func TestCancelSchedule(t *testing.T) {
+	ran := make(chan struct{}, 1)
+	id := schedule(time.Now().Add(50*time.Millisecond).UnixMilli(), func() {
+		ran <- struct{}{}
+	})
+	if id == "" {
+		t.Fatal("schedule() returned no id for a future task")
+	}
+
+	if !cancelSchedule(id) {
+		t.Fatal("cancelSchedule() = false for a pending task")
+	}
+	if cancelSchedule(id) {
+		t.Error("cancelSchedule() = true for an already cancelled task")
+	}
+
+	select {
+	case <-ran:
+		t.Error("cancelled task ran")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
 func TestParsePlaylistId(t *testing.T) {
 	tests := []struct {
-		name    string
-		input   string
-		want    string
-		wantErr bool
+		name     string
+		input    string
+		wantKind string
+		want     string
+		wantErr  bool
 	}{
 		{
-			name:    "valid playlist URI",
-			input:   "spotify:playlist:0qPA1tBtiCLVHCUfREECnO",
-			want:    "0qPA1tBtiCLVHCUfREECnO",
-			wantErr: false,
+			name:     "valid playlist URI",
+			input:    "spotify:playlist:0qPA1tBtiCLVHCUfREECnO",
+			wantKind: "playlist",
+			want:     "0qPA1tBtiCLVHCUfREECnO",
+			wantErr:  false,
+		},
+		{
+			name:     "album URI",
+			input:    "spotify:album:4aawyAB9vmqN3uQ7FjRGTy",
+			wantKind: "album",
+			want:     "4aawyAB9vmqN3uQ7FjRGTy",
+			wantErr:  false,
+		},
+		{
+			name:     "artist URI",
+			input:    "spotify:artist:0OdUWJ0sBjDrqHygGUXeCF",
+			wantKind: "artist",
+			want:     "0OdUWJ0sBjDrqHygGUXeCF",
+			wantErr:  false,
+		},
+		{
+			name:    "track URI",
+			input:   "spotify:track:6rqhFgbbKwnb9MLmUQDhG6",
+			wantErr: true,
 		},
 		{
 			name:    "invalid format",
@@ -151,18 +260,39 @@ func TestParsePlaylistId(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parsePlaylistId(tt.input)
+			kind, got, err := parseContextId(tt.input)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("parsePlaylistId() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("parseContextId() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
-				t.Errorf("parsePlaylistId() = %v, want %v", got, tt.want)
+			if kind != tt.wantKind || got != tt.want {
+				t.Errorf("parseContextId() = %v, %v, want %v, %v", kind, got, tt.wantKind, tt.want)
 			}
 		})
 	}
 }
 
+func TestParseTrackId(t *testing.T) {
+	tests := []struct {
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{uri: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", want: "4uLU6hMCjMI75M1A2tKUQC"},
+		{uri: "spotify:episode:512ojhOuo1ktJprKbVcKyQ", wantErr: true},
+		{uri: "spotify:track:", wantErr: true},
+		{uri: "spotify:track:a:b", wantErr: true},
+		{uri: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTrackId(tt.uri)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTrackId(%q) = %q, %v, want %q (error %v)", tt.uri, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
 func TestBuildSpotifySearchURL(t *testing.T) {
 	got := buildSpotifySearchURL("rock lofi", "playlist", 1)
 	want := "https://api.spotify.com/v1/search?limit=1&q=rock+lofi&type=playlist"
@@ -184,3 +314,302 @@ func TestFirstPlaylistURIFromSearchResponse(t *testing.T) {
 		t.Fatalf("name = %q", name)
 	}
 }
+
+func TestSearchResultsFromResponse(t *testing.T) {
+	body := []byte(`{
+		"tracks": {
+			"href": "https://api.spotify.com/v1/search?query=weightless&type=track&offset=0&limit=10",
+			"items": [
+				{"name": "Weightless", "uri": "spotify:track:6kkwzB6hXLIONkEk9JciA6", "duration_ms": 480000},
+				null,
+				{"name": "Weightless - Remix", "uri": "spotify:track:1pGXdp3xhGy1XbZVu2XRhr", "duration_ms": 301000}
+			],
+			"limit": 10,
+			"total": 2
+		}
+	}`)
+
+	got, err := searchResultsFromResponse(body, "track")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []searchResult{
+		{Name: "Weightless", URI: "spotify:track:6kkwzB6hXLIONkEk9JciA6"},
+		{Name: "Weightless - Remix", URI: "spotify:track:1pGXdp3xhGy1XbZVu2XRhr"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("results = %+v, want %+v", got, want)
+	}
+
+	// A type missing from the response is no results, not an error.
+	if got, err := searchResultsFromResponse(body, "album"); err != nil || len(got) != 0 {
+		t.Errorf("album results = %+v, %v, want none", got, err)
+	}
+}
+
+func TestPlaylistAllowed(t *testing.T) {
+	const allowed = "spotify:playlist:0qPA1tBtiCLVHCUfREECnO"
+
+	t.Setenv("PLAYLIST_ALLOWLIST", "")
+	if !playlistAllowed("spotify:playlist:anything") {
+		t.Error("playlistAllowed() with no allow-list = false, want true")
+	}
+
+	t.Setenv("PLAYLIST_ALLOWLIST", allowed+", spotify:album:abc123")
+	if !playlistAllowed(allowed) {
+		t.Errorf("playlistAllowed(%q) = false, want true", allowed)
+	}
+	if !playlistAllowed("spotify:album:abc123") {
+		t.Error("playlistAllowed() ignored an entry with surrounding spaces")
+	}
+	if playlistAllowed("spotify:playlist:blocked") {
+		t.Error("playlistAllowed() = true for a URI not in the allow-list")
+	}
+}
+
+func TestPrintResponseBody(t *testing.T) {
+	var logs bytes.Buffer
+	savedLogger := logger
+	logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	defer func() { logger = savedLogger }()
+
+	savedDebug := debugMode
+	defer func() { debugMode = savedDebug }()
+
+	const payload = `{"error":"secret details"}`
+
+	for _, debug := range []bool{false, true} {
+		logs.Reset()
+		debugMode = debug
+		resp := &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       io.NopCloser(strings.NewReader(payload)),
+		}
+
+		printResponseBody(resp)
+
+		if logged := strings.Contains(logs.String(), "secret details"); logged != debug {
+			t.Errorf("debugMode=%v: body logged = %v, want %v", debug, logged, debug)
+		}
+
+		// The caller must still be able to read the body.
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != payload {
+			t.Errorf("debugMode=%v: body after print = %q, want %q", debug, body, payload)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		raw   string
+		debug bool
+		want  slog.Level
+	}{
+		{raw: "", want: slog.LevelInfo},
+		{raw: "debug", want: slog.LevelDebug},
+		{raw: "WARN", want: slog.LevelWarn},
+		{raw: "error", want: slog.LevelError},
+		{raw: "loud", want: slog.LevelInfo},
+		{raw: "error", debug: true, want: slog.LevelDebug},
+	}
+
+	for _, tt := range tests {
+		if got := logLevel(tt.raw, tt.debug); got != tt.want {
+			t.Errorf("logLevel(%q, %v) = %s, want %s", tt.raw, tt.debug, got, tt.want)
+		}
+	}
+}
+
+func TestTransferVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		requested   int
+		source      int
+		sourceKnown bool
+		want        int
+	}{
+		{name: "requested wins", requested: 30, source: 80, sourceKnown: true, want: 30},
+		{name: "source carried over", source: 42, sourceKnown: true, want: 42},
+		{name: "muted source carried over", source: 0, sourceKnown: true, want: 0},
+		{name: "unknown source leaves destination alone", want: -1},
+	}
+
+	for _, tt := range tests {
+		if got := transferVolume(tt.requested, tt.source, tt.sourceKnown); got != tt.want {
+			t.Errorf("%s: transferVolume() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLimitQueue(t *testing.T) {
+	tracks := []Track{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{name: "longer than limit", limit: 2, want: 2},
+		{name: "shorter than limit", limit: 20, want: 3},
+		{name: "exact limit", limit: 3, want: 3},
+		{name: "zero limit", limit: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := limitQueue(tracks, tt.limit)
+			if len(got) != tt.want {
+				t.Fatalf("limitQueue(%d) returned %d items, want %d", tt.limit, len(got), tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tracks[i].Name {
+					t.Errorf("item %d = %q, want %q", i, got[i].Name, tracks[i].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestSummarizeRecent(t *testing.T) {
+	data, err := os.ReadFile("testdata/recently_played.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recent PlayHistory
+	if err := json.Unmarshal(data, &recent); err != nil {
+		t.Fatalf("decoding sample payload: %v", err)
+	}
+
+	got := summarizeRecent(&recent)
+	want := []recentTrack{
+		{
+			Track:    "Clair de Lune",
+			Artist:   "Claude Debussy, Philippe Entremont",
+			Uri:      "spotify:track:5u5aVJKjSMJr4zesMPz7bL",
+			PlayedAt: time.Date(2026, 10, 14, 21, 12, 45, 123e6, time.UTC),
+		},
+		{
+			Track:    "Weightless",
+			Artist:   "Marconi Union",
+			Uri:      "spotify:track:6kkwzB6hXLIONkEk9JciA6",
+			PlayedAt: time.Date(2026, 10, 14, 21, 4, 12, 4e6, time.UTC),
+		},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("summarizeRecent() returned %d tracks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Track != want[i].Track || got[i].Artist != want[i].Artist ||
+			got[i].Uri != want[i].Uri || !got[i].PlayedAt.Equal(want[i].PlayedAt) {
+			t.Errorf("track %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestValidateScheduleDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		horizon string
+		delay   time.Duration
+		wantErr bool
+	}{
+		{name: "within default horizon", delay: 8 * time.Hour, wantErr: false},
+		{name: "beyond default horizon", delay: 8 * 24 * time.Hour, wantErr: true},
+		{name: "past time", delay: -time.Minute, wantErr: true},
+		{name: "beyond configured horizon", horizon: "1h", delay: 2 * time.Hour, wantErr: true},
+		{name: "invalid horizon falls back to default", horizon: "soon", delay: 48 * time.Hour, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SCHEDULE_MAX_HORIZON", tt.horizon)
+			if err := validateScheduleDelay(tt.delay); (err != nil) != tt.wantErr {
+				t.Errorf("validateScheduleDelay(%s) error = %v, wantErr %v", tt.delay, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClosestImageFromPlaybackItem(t *testing.T) {
+	body := []byte(`{"is_playing":true,"item":{"name":"Song","album":{"images":[
+		{"url":"https://i.scdn.co/image/640","height":640,"width":640},
+		{"url":"https://i.scdn.co/image/300","height":300,"width":300},
+		{"url":"https://i.scdn.co/image/64","height":64,"width":64}
+	]}}}`)
+
+	var playback Playback
+	if err := json.Unmarshal(body, &playback); err != nil {
+		t.Fatalf("unmarshal playback: %v", err)
+	}
+	images := playback.Item.Album.Images
+	if len(images) != 3 {
+		t.Fatalf("decoded %d images, want 3", len(images))
+	}
+
+	tests := []struct {
+		size int
+		want string
+	}{
+		{size: 0, want: "https://i.scdn.co/image/640"},
+		{size: 250, want: "https://i.scdn.co/image/300"},
+		{size: 100, want: "https://i.scdn.co/image/64"},
+		{size: 2000, want: "https://i.scdn.co/image/640"},
+	}
+	for _, tt := range tests {
+		if got := closestImage(images, tt.size); got == nil || got.URL != tt.want {
+			t.Errorf("closestImage(%d) = %+v, want %s", tt.size, got, tt.want)
+		}
+	}
+
+	if got := closestImage(nil, 300); got != nil {
+		t.Errorf("closestImage(nil) = %+v, want nil", got)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("user-library-modify, user-read-playback-state")
+	if err != nil {
+		t.Fatalf("parseScopes: %v", err)
+	}
+	if strings.Join(scopes, " ") != "user-library-modify user-read-playback-state" {
+		t.Errorf("scopes = %v", scopes)
+	}
+
+	if scopes, _ := parseScopes(""); len(scopes) != len(defaultScopes) {
+		t.Errorf("empty value gave %v, want the defaults", scopes)
+	}
+
+	if _, err := parseScopes("user-libary-modify"); err == nil {
+		t.Error("expected an error for an unknown scope")
+	}
+}
+
+func TestAuthorizeURLUsesEnvScopes(t *testing.T) {
+	main := &Spotify{ClientId: "id", CallbackUri: "http://cb", Scopes: []string{"user-library-modify", "user-read-playback-state"}}
+	home := &Spotify{ClientId: "id", CallbackUri: "http://cb"}
+
+	for _, tc := range []struct {
+		sp   *Spotify
+		want string
+	}{
+		{main, "user-library-modify user-read-playback-state"},
+		{home, strings.Join(defaultScopes, " ")},
+	} {
+		u, err := url.Parse(tc.sp.authorizeURL("xyz", ""))
+		if err != nil {
+			t.Fatalf("parse auth URL: %v", err)
+		}
+		if got := u.Query().Get("scope"); got != tc.want {
+			t.Errorf("scope = %q, want %q", got, tc.want)
+		}
+		if got := u.Query().Get("state"); got != "xyz" {
+			t.Errorf("state = %q, want xyz", got)
+		}
+	}
+}